@@ -1,6 +1,8 @@
 package main
 
 import (
+	"os"
+
 	"github.com/codingbrain/clix.go/exts/bind"
 	"github.com/codingbrain/clix.go/exts/help"
 	"github.com/codingbrain/clix.go/flag"
@@ -8,10 +10,25 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "plugin" {
+		pluginMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "mqhub-sim" {
+		simMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "schema" {
+		schemaMain(os.Args[2:])
+		return
+	}
 	cli := &flag.CliDef{
 		Cli: &flag.Command{
 			Name: "see",
-			Desc: "Visualization Engine",
+			Desc: "Visualization Engine\n" +
+				"Use 'see plugin' to manage installed plugin bundles\n" +
+				"Use 'see mqhub-sim' to run mqhub schemas on a simulated hub\n" +
+				"Use 'see schema test' to test mqhub schemas with golden outputs",
 			Options: []*flag.Option{
 				{
 					Name:    "port",
@@ -30,11 +47,44 @@ func main() {
 				{
 					Name:    "plugin-dir",
 					Alias:   []string{"I"},
-					Desc:    "Visualize plugin directory for object renders",
+					Desc:    "Visualize plugin directory or bundle (.zip, .tar.gz) for object renders",
 					Example: "-I plugin-dir1 -I plugin-dir2",
 					List:    true,
 					Tags:    map[string]interface{}{"help-var": "DIR"},
 				},
+				{
+					Name:  "watch",
+					Alias: []string{"w"},
+					Desc:  "Watch plugins and web content, reload browsers on change",
+					Type:  "bool",
+				},
+				{
+					Name: "broker",
+					Desc: "Start an embedded MQTT broker listening on ADDR, like :1883,\n" +
+						"without SOURCE, the MQTT source is attached to it",
+					Type: "string",
+					Tags: map[string]interface{}{"help-var": "ADDR"},
+				},
+				{
+					Name: "broker-ws",
+					Desc: "WebSocket listening address of the embedded MQTT broker",
+					Type: "string",
+					Tags: map[string]interface{}{"help-var": "ADDR"},
+				},
+				{
+					Name: "mqhub-token",
+					Desc: "Token required for writing mqhub endpoints, which are read-only without it,\n" +
+						"default from $SEE_MQHUB_TOKEN",
+					Type: "string",
+					Tags: map[string]interface{}{"help-var": "TOKEN"},
+				},
+				{
+					Name: "admin-token",
+					Desc: "Token required by admin requests changing the server, which are\n" +
+						"only allowed from localhost without it, default from $SEE_ADMIN_TOKEN",
+					Type: "string",
+					Tags: map[string]interface{}{"help-var": "TOKEN"},
+				},
 				{
 					Name: "title",
 					Desc: "Title for web page",
@@ -51,8 +101,14 @@ func main() {
 					Name: "source",
 					Desc: "Message source, can be a program or a URL\n" +
 						"Supported protocol:\n" +
-						"   MQHUB: mqhub://server:port/topic-prefix SCHEMA-FILE\n" +
-						"   MQTT:  mqtt://server:port/topic-prefix\n",
+						"   MQHUB: mqhub://server:port/topic-prefix SCHEMA-FILE...\n" +
+						"   MQTT:  mqtt://server:port/topic-prefix[?options]\n" +
+						"          mqtts://server:port/topic-prefix[?options]\n" +
+						"          mqtt5://server:port/topic-prefix[?options]\n" +
+						"   TCP:   tcp://:port to accept programs connecting\n" +
+						"          tcp+connect://host:port[?options] to connect to a server\n" +
+						"   UNIX:  unix:///path/to.sock[?mode=0660] to accept local programs connecting\n" +
+						"   FIFO:  fifo:///path/to/pipe to read from a named pipe\n",
 					Type: "string",
 					Tags: map[string]interface{}{"help-var": "SOURCE"},
 				},
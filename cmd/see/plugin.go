@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/codingbrain/clix.go/exts/bind"
+	"github.com/codingbrain/clix.go/exts/help"
+	"github.com/codingbrain/clix.go/flag"
+	"github.com/codingbrain/clix.go/term"
+	vis "github.com/robotalks/see/pkg/vis"
+)
+
+func pluginMain(args []string) {
+	bundleArg := []*flag.Option{
+		{
+			Name:     "bundle",
+			Desc:     "Plugin bundle file (.zip, .tar.gz)",
+			Type:     "string",
+			Required: true,
+			Tags:     map[string]interface{}{"help-var": "BUNDLE"},
+		},
+	}
+	cli := &flag.CliDef{
+		Cli: &flag.Command{
+			Name: "see plugin",
+			Desc: "Manage plugin bundles installed in $HOME/.robotalks/plugins",
+			Commands: []*flag.Command{
+				{
+					Name: "list",
+					Desc: "List installed plugins",
+				},
+				{
+					Name:      "install",
+					Desc:      "Verify and install a plugin bundle",
+					Arguments: bundleArg,
+				},
+				{
+					Name:      "verify",
+					Desc:      "Verify a plugin bundle",
+					Arguments: bundleArg,
+				},
+				{
+					Name: "remove",
+					Desc: "Remove an installed plugin",
+					Arguments: []*flag.Option{
+						{
+							Name:     "name",
+							Desc:     "Plugin name",
+							Type:     "string",
+							Required: true,
+							Tags:     map[string]interface{}{"help-var": "NAME"},
+						},
+					},
+				},
+			},
+		},
+	}
+	cli.Normalize()
+	cli.Use(term.NewExt()).
+		Use(bind.NewExt().
+			Bind(&pluginListCmd{}, "list").
+			Bind(&pluginInstallCmd{}, "install").
+			Bind(&pluginVerifyCmd{}, "verify").
+			Bind(&pluginRemoveCmd{}, "remove")).
+		Use(help.NewExt()).
+		ParseArgs(append([]string{"see-plugin"}, args...)...).
+		Exec()
+}
+
+func printManifest(name string, mf *vis.PluginManifest) {
+	version := mf.Version
+	if version == "" {
+		version = "-"
+	}
+	fmt.Printf("%s\t%s", name, version)
+	if len(mf.Types) > 0 {
+		fmt.Printf("\ttypes: %v", mf.Types)
+	}
+	if len(mf.Requires) > 0 {
+		fmt.Printf("\trequires:")
+		for _, dep := range mf.Requires {
+			fmt.Printf(" %s%s", dep.Name, dep.Version)
+		}
+	}
+	fmt.Println()
+}
+
+type pluginListCmd struct {
+}
+
+func (c *pluginListCmd) Execute(args []string) error {
+	reg, err := vis.DefaultPluginRegistry()
+	if err != nil {
+		return err
+	}
+	list, err := reg.List()
+	if err != nil {
+		return err
+	}
+	for _, e := range list {
+		if e.Err != nil {
+			fmt.Printf("%s\tinvalid: %v\n", e.Name, e.Err)
+		} else {
+			printManifest(e.Name, e.Manifest)
+		}
+	}
+	return nil
+}
+
+type pluginInstallCmd struct {
+	Bundle string
+}
+
+func (c *pluginInstallCmd) Execute(args []string) error {
+	reg, err := vis.DefaultPluginRegistry()
+	if err != nil {
+		return err
+	}
+	e, err := reg.Install(c.Bundle)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Installed %s\n", e.File)
+	return nil
+}
+
+type pluginVerifyCmd struct {
+	Bundle string
+}
+
+func (c *pluginVerifyCmd) Execute(args []string) error {
+	mf, err := vis.VerifyPluginBundle(c.Bundle)
+	if err != nil {
+		return fmt.Errorf("%s: %w", c.Bundle, err)
+	}
+	printManifest(c.Bundle, mf)
+	return nil
+}
+
+type pluginRemoveCmd struct {
+	Name string
+}
+
+func (c *pluginRemoveCmd) Execute(args []string) error {
+	reg, err := vis.DefaultPluginRegistry()
+	if err != nil {
+		return err
+	}
+	return reg.Remove(c.Name)
+}
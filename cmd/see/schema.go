@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/codingbrain/clix.go/exts/bind"
+	"github.com/codingbrain/clix.go/exts/help"
+	"github.com/codingbrain/clix.go/flag"
+	"github.com/codingbrain/clix.go/term"
+	"github.com/robotalks/see/pkg/vis/mqhub"
+)
+
+func schemaMain(args []string) {
+	cli := &flag.CliDef{
+		Cli: &flag.Command{
+			Name: "see schema",
+			Desc: "Develop mqhub schemas",
+			Commands: []*flag.Command{
+				{
+					Name: "test",
+					Desc: "Apply fixture states and events to schemas and compare with golden outputs",
+					Options: []*flag.Option{
+						{
+							Name:  "update",
+							Alias: []string{"u"},
+							Desc:  "Write the outputs as golden instead of comparing",
+							Type:  "bool",
+						},
+					},
+					Arguments: []*flag.Option{
+						{
+							Name:     "test",
+							Desc:     "Test files",
+							Type:     "string",
+							List:     true,
+							Required: true,
+							Tags:     map[string]interface{}{"help-var": "TEST-FILE"},
+						},
+					},
+				},
+			},
+		},
+	}
+	cli.Normalize()
+	cli.Use(term.NewExt()).
+		Use(bind.NewExt().
+			Bind(&schemaTestCmd{}, "test")).
+		Use(help.NewExt()).
+		ParseArgs(append([]string{"see-schema"}, args...)...).
+		Exec()
+}
+
+type schemaTestCmd struct {
+	Update bool
+}
+
+func (c *schemaTestCmd) Execute(args []string) error {
+	failed := 0
+	for _, fn := range args {
+		if err := c.run(fn); err != nil {
+			fmt.Printf("FAIL %s: %v\n", fn, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d tests failed", failed, len(args))
+	}
+	return nil
+}
+
+func (c *schemaTestCmd) run(fn string) error {
+	t, err := mqhub.LoadSchemaTest(fn)
+	if err != nil {
+		return err
+	}
+	out, err := t.Run()
+	if err != nil {
+		return err
+	}
+	golden := t.GoldenFile()
+	if c.Update {
+		if err = os.WriteFile(golden, out, 0644); err != nil {
+			return err
+		}
+		fmt.Printf("UPDATED %s\n", golden)
+		return nil
+	}
+	expected, err := os.ReadFile(golden)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%s doesn't exist, create it with --update", golden)
+	} else if err != nil {
+		return err
+	}
+	if !bytes.Equal(expected, out) {
+		return fmt.Errorf("output differs from %s (-golden +actual):\n%s", golden,
+			diffLines(string(expected), string(out)))
+	}
+	fmt.Printf("PASS %s\n", fn)
+	return nil
+}
+
+// diffLines shows lines only in a with "-", only in b with "+", and
+// the section headers for context
+func diffLines(a, b string) string {
+	as := strings.Split(strings.TrimSuffix(a, "\n"), "\n")
+	bs := strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+	// lcs[i][j] is the length of the common subsequence of as[i:] and bs[j:]
+	lcs := make([][]int, len(as)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bs)+1)
+	}
+	for i := len(as) - 1; i >= 0; i-- {
+		for j := len(bs) - 1; j >= 0; j-- {
+			if as[i] == bs[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var out strings.Builder
+	i, j := 0, 0
+	for i < len(as) || j < len(bs) {
+		switch {
+		case i < len(as) && j < len(bs) && as[i] == bs[j]:
+			if strings.HasPrefix(as[i], "#") {
+				out.WriteString("  " + as[i] + "\n")
+			}
+			i++
+			j++
+		case i < len(as) && (j == len(bs) || lcs[i+1][j] >= lcs[i][j+1]):
+			out.WriteString("- " + as[i] + "\n")
+			i++
+		default:
+			out.WriteString("+ " + bs[j] + "\n")
+			j++
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/codingbrain/clix.go/exts/bind"
+	"github.com/codingbrain/clix.go/exts/help"
+	"github.com/codingbrain/clix.go/flag"
+	"github.com/codingbrain/clix.go/term"
+	"github.com/robotalks/see/pkg/vis/mqhub"
+)
+
+func simMain(args []string) {
+	cli := &flag.CliDef{
+		Cli: &flag.Command{
+			Name: "see mqhub-sim",
+			Desc: "Run mqhub schemas on a simulated hub fed by a script,\n" +
+				"messages sent to the hub are printed as COMPONENT/ENDPOINT PAYLOAD",
+			Options: []*flag.Option{
+				{
+					Name:    "port",
+					Alias:   []string{"p"},
+					Desc:    "Listening port",
+					Tags:    map[string]interface{}{"help-var": "PORT"},
+					Type:    "int",
+					Default: 3500,
+				},
+				{
+					Name:  "quiet",
+					Alias: []string{"q"},
+					Desc:  "Turn off the logs",
+					Type:  "bool",
+				},
+				{
+					Name:    "plugin-dir",
+					Alias:   []string{"I"},
+					Desc:    "Visualize plugin directory or bundle (.zip, .tar.gz) for object renders",
+					Example: "-I plugin-dir1 -I plugin-dir2",
+					List:    true,
+					Tags:    map[string]interface{}{"help-var": "DIR"},
+				},
+				{
+					Name: "mqhub-token",
+					Desc: "Token required for writing mqhub endpoints, which are read-only without it,\n" +
+						"default from $SEE_MQHUB_TOKEN",
+					Type: "string",
+					Tags: map[string]interface{}{"help-var": "TOKEN"},
+				},
+				{
+					Name: "title",
+					Desc: "Title for web page",
+					Type: "string",
+				},
+				{
+					Name: "loop",
+					Desc: "Replay the script from the start when it ends",
+					Type: "bool",
+				},
+			},
+			Arguments: []*flag.Option{
+				{
+					Name:     "script",
+					Desc:     "Script of timed states and events (YAML or JSON)",
+					Type:     "string",
+					Required: true,
+					Tags:     map[string]interface{}{"help-var": "SCRIPT"},
+				},
+				{
+					Name:     "schema",
+					Desc:     "Schema files",
+					Type:     "string",
+					List:     true,
+					Required: true,
+					Tags:     map[string]interface{}{"help-var": "SCHEMA-FILE"},
+				},
+			},
+		},
+	}
+	cli.Normalize()
+	cli.Use(term.NewExt()).
+		Use(bind.NewExt().Bind(&simCmd{})).
+		Use(help.NewExt()).
+		ParseArgs(append([]string{"see-mqhub-sim"}, args...)...).
+		Exec()
+}
+
+type simCmd struct {
+	Port       int
+	Quiet      bool
+	PluginDirs []string `n:"plugin-dir"`
+	MQHubToken string   `n:"mqhub-token"`
+	Title      string
+	Loop       bool
+}
+
+func (c *simCmd) Execute(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("mqhub-sim expects a script and schema files")
+	}
+	script, err := mqhub.LoadSimScript(args[0])
+	if err != nil {
+		return err
+	}
+	if c.Loop {
+		script.Loop = true
+	}
+
+	vc := &visCmd{
+		Port:       c.Port,
+		Quiet:      c.Quiet,
+		PluginDirs: c.PluginDirs,
+		MQHubToken: c.MQHubToken,
+		Title:      c.Title,
+	}
+	conn := mqhub.NewSimConnector()
+	conn.OnSend = func(msg mqhub.SimMessage) {
+		fmt.Printf("%s/%s %s\n", msg.Component, msg.Endpoint, msg.Payload)
+	}
+	src, err := mqhub.NewMsgSourceWithConnector(conn, args[1:]...)
+	if err != nil {
+		return err
+	}
+	src.WriteToken = vc.mqhubToken()
+	if err = src.Connect(); err != nil {
+		return err
+	}
+	if err = src.Watch(); err != nil {
+		return err
+	}
+
+	srv, err := vc.newServer()
+	if err != nil {
+		return err
+	}
+	go script.Play(conn, src, nil)
+	return vc.serve(srv, src)
+}
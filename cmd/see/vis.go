@@ -1,13 +1,20 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net"
+	"net/url"
 	"os"
+	"os/signal"
 	"os/user"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 
 	logger "github.com/op/go-logging"
 	vis "github.com/robotalks/see/pkg/vis"
@@ -30,6 +37,11 @@ type visCmd struct {
 	Port       int
 	Quiet      bool
 	PluginDirs []string `n:"plugin-dir"`
+	Watch      bool
+	Broker     string
+	BrokerWS   string `n:"broker-ws"`
+	MQHubToken string `n:"mqhub-token"`
+	AdminToken string `n:"admin-token"`
 	Title      string
 	Version    bool
 
@@ -42,28 +54,30 @@ func (c *visCmd) Execute(args []string) error {
 		return nil
 	}
 
-	c.logger = logger.MustGetLogger("see")
-	if c.Quiet {
-		logger.SetLevel(logger.NOTICE, c.logger.Module)
-	} else {
-		logger.SetLevel(logger.INFO, c.logger.Module)
-	}
-
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", c.Port))
+	srv, err := c.newServer()
 	if err != nil {
 		return err
 	}
-	srv := &vis.Server{
-		Listener:      ln,
-		States:        &vis.MemStateStore{},
-		Title:         c.Title,
-		LocalWebDir:   ".vis.www",
-		WebContentDir: os.Getenv("SEE_WEB_ROOT"),
-		Logger:        c.logger,
+	if c.Watch {
+		w, e := srv.Watch()
+		if e != nil {
+			return e
+		}
+		defer w.Close()
 	}
 
-	if err = c.loadPlugins(srv); err != nil {
-		return err
+	if c.Broker != "" {
+		broker := &mqtt.Broker{Address: c.Broker, WebSocketAddress: c.BrokerWS, Verbose: !c.Quiet}
+		if err = broker.Start(); err != nil {
+			return err
+		}
+		defer broker.Close()
+		c.logger.Noticef("MQTT broker %s", c.Broker)
+		if len(args) == 0 || args[0] == "" {
+			args = []string{broker.SourceURL("")}
+		}
+	} else if c.BrokerWS != "" {
+		return fmt.Errorf("--broker-ws requires --broker")
 	}
 
 	var source vis.MsgSource
@@ -72,27 +86,50 @@ func (c *visCmd) Execute(args []string) error {
 		source = &vis.StreamMsgSource{Reader: os.Stdin, Writer: os.Stdout}
 	case strings.HasPrefix(args[0], "mqhub://"):
 		if len(args) < 2 {
-			return fmt.Errorf("mqhub expects schema file as second argument")
+			return fmt.Errorf("mqhub expects schema files after URL")
 		}
-		src, e := mqhub.NewMsgSource("mqtt"+args[0][5:], args[1])
+		src, e := mqhub.NewMsgSource("mqtt"+args[0][5:], args[1:]...)
 		if e != nil {
 			return e
 		}
+		src.WriteToken = c.mqhubToken()
 		if err = src.Connect(); err != nil {
 			return err
 		}
+		if err = src.Watch(); err != nil {
+			return err
+		}
 		source = src
-	case strings.HasPrefix(args[0], "mqtt://"):
-		src, e := mqtt.NewMsgSourceFromURL("tcp" + args[0][4:])
+	case strings.HasPrefix(args[0], "mqtt://"),
+		strings.HasPrefix(args[0], "mqtts://"),
+		strings.HasPrefix(args[0], "mqtt5://"),
+		strings.HasPrefix(args[0], "mqtts5://"),
+		strings.HasPrefix(args[0], "ssl://"):
+		src, e := mqtt.NewMsgSourceFromURL(args[0])
 		if e != nil {
 			return e
 		}
 		if len(args) > 1 {
 			src.ClientID = args[1]
 		}
+		var pub *mqtt.StatePublisher
+		if src.PublishState {
+			pub = src.NewStatePublisher(srv.States)
+			srv.Observers = append(srv.Observers, pub)
+		}
 		if err = src.Connect(); err != nil {
 			return err
 		}
+		if pub != nil {
+			// the publisher uses the client created by Connect
+			go pub.Run(nil)
+		}
+		source = src
+	case strings.HasPrefix(args[0], "tcp+connect://"):
+		src, e := vis.NewConnectMsgSourceFromURL(args[0])
+		if e != nil {
+			return e
+		}
 		source = src
 	case strings.HasPrefix(args[0], "tcp://"):
 		ln, e := net.Listen("tcp", args[0][6:])
@@ -100,6 +137,31 @@ func (c *visCmd) Execute(args []string) error {
 			return e
 		}
 		source = vis.NewListenerSource(ln)
+	case strings.HasPrefix(args[0], "unix://"):
+		u, e := url.Parse(args[0])
+		if e != nil {
+			return e
+		}
+		mode, e := strconv.ParseUint(u.Query().Get("mode"), 8, 32)
+		if u.Query().Get("mode") == "" {
+			mode, e = 0660, nil
+		}
+		if e != nil {
+			return fmt.Errorf("invalid mode: %w", e)
+		}
+		ln, e := vis.ListenUnix(u.Host+u.Path, os.FileMode(mode))
+		if e != nil {
+			return e
+		}
+		defer ln.Close()
+		closeOnSignal(ln)
+		source = vis.NewListenerSource(ln)
+	case strings.HasPrefix(args[0], "fifo://"):
+		src, e := vis.NewFifoMsgSource(args[0][7:])
+		if e != nil {
+			return e
+		}
+		source = src
 	default:
 		if len(args) == 0 || args[0] == "" {
 			args = []string{"./.vis.exec"}
@@ -114,34 +176,96 @@ func (c *visCmd) Execute(args []string) error {
 		src.Cmd.Process.Release()
 		source = src
 	}
+	return c.serve(srv, source)
+}
+
+func (c *visCmd) newServer() (*vis.Server, error) {
+	c.logger = logger.MustGetLogger("see")
+	if c.Quiet {
+		logger.SetLevel(logger.NOTICE, c.logger.Module)
+	} else {
+		logger.SetLevel(logger.INFO, c.logger.Module)
+	}
+
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", c.Port))
+	if err != nil {
+		return nil, err
+	}
+	srv := &vis.Server{
+		Listener:      ln,
+		States:        &vis.MemStateStore{},
+		Title:         c.Title,
+		LocalWebDir:   ".vis.www",
+		WebContentDir: os.Getenv("SEE_WEB_ROOT"),
+		Logger:        c.logger,
+		AdminToken:    c.AdminToken,
+	}
+	if srv.AdminToken == "" {
+		srv.AdminToken = os.Getenv("SEE_ADMIN_TOKEN")
+	}
+	if err = c.loadPlugins(srv); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return srv, nil
+}
+
+// serve runs the server with the source until either fails
+func (c *visCmd) serve(srv *vis.Server, source vis.MsgSource) error {
 	srv.MsgSink = source
 
-	c.logger.Noticef("Listen %s", ln.(*net.TCPListener).Addr().String())
+	c.logger.Noticef("Listen %s", srv.Listener.Addr().String())
 
 	errCh := make(chan error)
 	go c.runServer(source, srv, errCh)
 	go c.processMsgs(source, srv, errCh)
-	err = <-errCh
+	err := <-errCh
 	if err == io.EOF {
 		err = nil
 	}
 	return err
 }
 
+func (c *visCmd) mqhubToken() string {
+	if c.MQHubToken != "" {
+		return c.MQHubToken
+	}
+	return os.Getenv("SEE_MQHUB_TOKEN")
+}
+
+// closeOnSignal closes c and exits on interrupt or termination, like
+// removing the socket file of a Unix domain socket listener
+func closeOnSignal(c io.Closer) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		c.Close()
+		os.Exit(1)
+	}()
+}
+
 func (c *visCmd) loadPlugins(srv *vis.Server) error {
 	usr, err := user.Current()
 	if err == nil {
-		srv.LoadPlugin(filepath.Join(usr.HomeDir, ".robotalks"))
+		c.loadOptionalPlugin(srv, filepath.Join(usr.HomeDir, ".robotalks"))
+	}
+	if reg, e := vis.DefaultPluginRegistry(); e == nil {
+		bundles, e := reg.List()
+		if e != nil {
+			c.logger.Warningf("Plugin registry %s: %v", reg.Dir, e)
+		}
+		for _, b := range bundles {
+			c.loadOptionalPlugin(srv, b.File)
+		}
 	}
 	wd, err := os.Getwd()
 	if err == nil {
-		srv.LoadPlugin(wd)
+		c.loadOptionalPlugin(srv, wd)
 	}
 	if dirs := os.Getenv("SEE_PLUGIN_PATH"); dirs != "" {
 		for _, dir := range filepath.SplitList(dirs) {
-			if srv.LoadPlugin(dir) == nil {
-				c.logger.Infof("Loaded %s", dir)
-			}
+			c.loadOptionalPlugin(srv, dir)
 		}
 	}
 	for _, dir := range c.PluginDirs {
@@ -150,19 +274,46 @@ func (c *visCmd) loadPlugins(srv *vis.Server) error {
 		}
 		c.logger.Infof("Loaded %s", dir)
 	}
+	// only plugins given explicitly must resolve, discovered ones are
+	// skipped with a warning
+	errs := srv.PluginResolveErrors()
+	for _, dir := range c.PluginDirs {
+		if err = errs[dir]; err != nil {
+			return fmt.Errorf("%s: %v", dir, err)
+		}
+	}
+	dirs := make([]string, 0, len(errs))
+	for dir := range errs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		c.logger.Warningf("Plugin %s skipped: %v", dir, errs[dir])
+	}
 	return nil
 }
 
+func (c *visCmd) loadOptionalPlugin(srv *vis.Server, dir string) {
+	err := srv.LoadPlugin(dir)
+	switch {
+	case err == nil:
+		c.logger.Infof("Loaded %s", dir)
+	case !errors.Is(err, fs.ErrNotExist):
+		c.logger.Warningf("Plugin %v", err)
+	}
+}
+
 func (c *visCmd) runServer(ext interface{}, srv *vis.Server, errCh chan error) {
 	srvExt, _ := ext.(vis.ServerExt)
 	errCh <- srv.Serve(srvExt)
 }
 
-func (c *visCmd) processMsgs(source vis.MsgSource, sink vis.MessageSink, errCh chan error) {
+func (c *visCmd) processMsgs(source vis.MsgSource, srv *vis.Server, errCh chan error) {
 	for {
-		err := source.ProcessMessages(sink)
+		err := source.ProcessMessages(srv)
 		if err != nil {
 			if err != io.EOF {
+				srv.ReportError("source", err)
 				errCh <- err
 			}
 			break
@@ -5,16 +5,22 @@ go 1.19
 require (
 	github.com/codingbrain/clix.go v0.0.0-20160913060523-61f1fdb54558
 	github.com/easeway/langx.go v0.0.0-20170304050229-26b1f7c6dca0
+	github.com/eclipse/paho.golang v0.11.0
 	github.com/eclipse/paho.mqtt.golang v1.4.2
+	github.com/fsnotify/fsnotify v1.6.0
+	github.com/mochi-mqtt/server/v2 v2.3.0
 	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
 	github.com/robotalks/mqhub.go v0.0.0-20170129062435-3c92e551de14
 	github.com/rs/xid v1.4.0
+	github.com/rs/zerolog v1.28.0
 	golang.org/x/net v0.8.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/gorilla/websocket v1.4.2 // indirect
+	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/mattn/go-colorable v0.1.12 // indirect
+	github.com/mattn/go-isatty v0.0.14 // indirect
 	github.com/stretchr/testify v1.8.2 // indirect
 	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2 // indirect
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
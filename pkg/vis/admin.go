@@ -0,0 +1,266 @@
+package vis
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AdminPrefix is the URL prefix of the introspection API
+const AdminPrefix = "/_admin/"
+
+// MaxRecentErrors is the number of recent errors kept for introspection
+const MaxRecentErrors = 100
+
+// MsgError records a failure in message processing
+type MsgError struct {
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`
+	Action  string    `json:"action,omitempty"`
+	Error   string    `json:"error"`
+	Message string    `json:"message,omitempty"`
+}
+
+// SourceStatus describes the state of a message source
+type SourceStatus struct {
+	Kind      string                 `json:"kind"`
+	Address   string                 `json:"address,omitempty"`
+	Connected bool                   `json:"connected"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+// StatusReporter is implemented by message sources reporting their state
+type StatusReporter interface {
+	SourceStatus() SourceStatus
+}
+
+// PluginInfo describes a loaded plugin
+type PluginInfo struct {
+	Name     string          `json:"name"`
+	Dir      string          `json:"dir"`
+	FullDir  string          `json:"full-dir"`
+	Manifest *PluginManifest `json:"manifest,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// AssetInfo describes an asset held by the server
+type AssetInfo struct {
+	ID          string `json:"id"`
+	ContentType string `json:"content-type"`
+	Size        int    `json:"size"`
+}
+
+// ReportError records an error for introspection
+func (s *Server) ReportError(source string, err error) {
+	s.recordError(MsgError{Time: time.Now(), Source: source, Error: err.Error()})
+}
+
+func (s *Server) recordError(e MsgError) {
+	s.errorsLock.Lock()
+	s.errors = append(s.errors, e)
+	if len(s.errors) > MaxRecentErrors {
+		s.errors = s.errors[len(s.errors)-MaxRecentErrors:]
+	}
+	s.errorsLock.Unlock()
+}
+
+// RecentErrors returns recent errors, latest last
+func (s *Server) RecentErrors() []MsgError {
+	s.errorsLock.RLock()
+	errs := make([]MsgError, len(s.errors))
+	copy(errs, s.errors)
+	s.errorsLock.RUnlock()
+	return errs
+}
+
+// Clients lists connected WebSocket clients
+func (s *Server) Clients() []ClientInfo {
+	clients := s.clients()
+	infos := make([]ClientInfo, 0, len(clients))
+	for _, c := range clients {
+		infos = append(infos, c.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ConnectedAt.Before(infos[j].ConnectedAt)
+	})
+	return infos
+}
+
+// DisconnectClient disconnects a WebSocket client by ID
+func (s *Server) DisconnectClient(id string) bool {
+	for _, c := range s.clients() {
+		if c.id == id {
+			c.close()
+			return true
+		}
+	}
+	return false
+}
+
+// Plugins lists loaded plugins with resolved manifests
+func (s *Server) Plugins() []PluginInfo {
+	s.pluginsLock.RLock()
+	defer s.pluginsLock.RUnlock()
+	infos := make([]PluginInfo, 0, len(s.plugins))
+	for _, p := range s.plugins {
+		info := PluginInfo{Name: p.name, Dir: p.dir, FullDir: p.fullDir, Manifest: p.manifest}
+		if p.err != nil {
+			info.Error = p.err.Error()
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// ReloadPlugins re-resolves manifests of all loaded plugins, unloads
+// plugins whose manifest is gone and loads plugins whose manifest appears
+func (s *Server) ReloadPlugins() {
+	s.pluginsLock.Lock()
+	plugins := make([]*plugin, 0, len(s.plugins))
+	loaded := make(map[string]bool)
+	for _, p := range s.plugins {
+		var fsys fs.FS
+		if fsys, p.err = OpenPluginFS(p.fullDir); p.err == nil {
+			p.fsys = fsys
+			p.manifest, p.err = loadValidManifest(fsys)
+		}
+		if errors.Is(p.err, fs.ErrNotExist) {
+			s.Logger.Noticef("Plugin %s (%s) removed", p.name, p.dir)
+			continue
+		}
+		if p.err != nil {
+			s.Logger.Warningf("Reload plugin %s (%s) failed: %v", p.name, p.dir, p.err)
+		}
+		plugins = append(plugins, p)
+		loaded[p.spec] = true
+	}
+	s.plugins = plugins
+	s.invalidateObjectTypes()
+	specs := make([]string, len(s.pluginSpecs))
+	copy(specs, s.pluginSpecs)
+	s.pluginsLock.Unlock()
+
+	for _, spec := range specs {
+		if !loaded[spec] && s.loadPlugin(spec) == nil {
+			s.Logger.Noticef("Plugin %s added", spec)
+		}
+	}
+}
+
+// Sources lists the status of active message sources
+func (s *Server) Sources() []SourceStatus {
+	var sources []SourceStatus
+	if r, ok := s.MsgSink.(StatusReporter); ok {
+		sources = append(sources, r.SourceStatus())
+	}
+	return sources
+}
+
+// Assets lists assets held by the server
+func (s *Server) Assets() []AssetInfo {
+	s.assetsLock.RLock()
+	infos := make([]AssetInfo, 0, len(s.assets))
+	for id, a := range s.assets {
+		infos = append(infos, AssetInfo{ID: id, ContentType: a.contentType, Size: len(a.data)})
+	}
+	s.assetsLock.RUnlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// adminAuthorized checks requests changing the server, which require
+// AdminToken as "Authorization: Bearer TOKEN", or come from loopback
+// without AdminToken
+func (s *Server) adminAuthorized(r *http.Request) bool {
+	if s.AdminToken != "" {
+		token := r.Header.Get("Authorization")
+		return strings.HasPrefix(token, "Bearer ") &&
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(token, "Bearer ")), []byte(s.AdminToken)) == 1
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// AdminHandler is the http handler of the introspection API
+func (s *Server) AdminHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, AdminPrefix), "/"), "/")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && !s.adminAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case len(parts) == 1 && parts[0] == "" && r.Method == http.MethodGet:
+		writeJSON(w, map[string]interface{}{
+			"clients": s.Clients(),
+			"plugins": s.Plugins(),
+			"sources": s.Sources(),
+			"assets":  s.Assets(),
+			"errors":  s.RecentErrors(),
+		})
+	case len(parts) == 1 && parts[0] == "clients" && r.Method == http.MethodGet:
+		writeJSON(w, s.Clients())
+	case len(parts) == 2 && parts[0] == "clients" && r.Method == http.MethodDelete:
+		if !s.DisconnectClient(parts[1]) {
+			http.Error(w, fmt.Sprintf("client %s not found", parts[1]), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 1 && parts[0] == "plugins" && r.Method == http.MethodGet:
+		writeJSON(w, s.Plugins())
+	case len(parts) == 1 && parts[0] == "plugins" && r.Method == http.MethodPost:
+		var req struct {
+			Dir string `json:"dir"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Dir == "" {
+			http.Error(w, "expect {\"dir\": \"[name=]dir\"}", http.StatusBadRequest)
+			return
+		}
+		if err := s.LoadPlugin(req.Dir); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.NotifyReload(false)
+		writeJSON(w, s.Plugins())
+	case len(parts) == 2 && parts[0] == "plugins" && parts[1] == "reload" && r.Method == http.MethodPost:
+		s.ReloadPlugins()
+		s.NotifyReload(false)
+		writeJSON(w, s.Plugins())
+	case len(parts) == 2 && parts[0] == "plugins" && r.Method == http.MethodDelete:
+		if !s.RemovePlugin(parts[1]) {
+			http.Error(w, fmt.Sprintf("plugin %s not found", parts[1]), http.StatusNotFound)
+			return
+		}
+		s.NotifyReload(false)
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 1 && parts[0] == "sources" && r.Method == http.MethodGet:
+		writeJSON(w, s.Sources())
+	case len(parts) == 1 && parts[0] == "assets" && r.Method == http.MethodGet:
+		writeJSON(w, s.Assets())
+	case len(parts) == 1 && parts[0] == "errors" && r.Method == http.MethodGet:
+		writeJSON(w, s.RecentErrors())
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(encoded)
+}
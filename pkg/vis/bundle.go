@@ -0,0 +1,234 @@
+package vis
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// PluginBundleExts are file extensions of plugin bundles
+var PluginBundleExts = []string{".zip", ".tar.gz", ".tgz"}
+
+// PluginBundleExt returns the bundle extension of the file, or empty
+// if the file is not a plugin bundle
+func PluginBundleExt(fn string) string {
+	lower := strings.ToLower(fn)
+	for _, ext := range PluginBundleExts {
+		if strings.HasSuffix(lower, ext) {
+			return fn[len(fn)-len(ext):]
+		}
+	}
+	return ""
+}
+
+// OpenPluginFS opens a plugin directory or bundle as a file system
+func OpenPluginFS(fn string) (fs.FS, error) {
+	if PluginBundleExt(fn) == "" {
+		return os.DirFS(fn), nil
+	}
+	raw, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	if ext := strings.ToLower(PluginBundleExt(fn)); ext != ".zip" {
+		if raw, err = tarToZip(raw); err != nil {
+			return nil, err
+		}
+	}
+	zr, err := zip.NewReader(bytes.NewReader(raw), int64(len(raw)))
+	if err != nil {
+		return nil, err
+	}
+	return bundleRoot(zr)
+}
+
+// tarToZip converts a gzipped tarball into zip for random access
+func tarToZip(raw []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	var out bytes.Buffer
+	zw := zip.NewWriter(&out)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     strings.TrimPrefix(hdr.Name, "./"),
+			Method:   zip.Store,
+			Modified: hdr.ModTime,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err = io.Copy(w, tr); err != nil {
+			return nil, err
+		}
+	}
+	if err = zw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// bundleRoot locates the directory containing the manifest, which is
+// either the root or the only top-level directory
+func bundleRoot(fsys fs.FS) (fs.FS, error) {
+	if _, err := fs.Stat(fsys, PluginManifestFile); err == nil {
+		return fsys, nil
+	}
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 1 && entries[0].IsDir() {
+		if _, err = fs.Stat(fsys, entries[0].Name()+"/"+PluginManifestFile); err == nil {
+			return fs.Sub(fsys, entries[0].Name())
+		}
+	}
+	return nil, fmt.Errorf("%s not found in bundle: %w", PluginManifestFile, fs.ErrNotExist)
+}
+
+// VerifyPluginBundle loads and validates the manifest in a plugin bundle
+func VerifyPluginBundle(fn string) (*PluginManifest, error) {
+	fsys, err := OpenPluginFS(fn)
+	if err != nil {
+		return nil, err
+	}
+	return loadValidManifest(fsys)
+}
+
+// PluginRegistry is a local directory of installed plugin bundles
+type PluginRegistry struct {
+	Dir string
+}
+
+// RegistryEntry is an installed plugin bundle
+type RegistryEntry struct {
+	Name     string
+	File     string
+	Manifest *PluginManifest
+	Err      error
+}
+
+// DefaultPluginRegistry returns the registry in $HOME/.robotalks/plugins
+func DefaultPluginRegistry() (*PluginRegistry, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	return &PluginRegistry{Dir: filepath.Join(home, ".robotalks", "plugins")}, nil
+}
+
+// List lists installed plugin bundles
+func (r *PluginRegistry) List() ([]RegistryEntry, error) {
+	entries, err := os.ReadDir(r.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []RegistryEntry
+	for _, entry := range entries {
+		ext := PluginBundleExt(entry.Name())
+		if entry.IsDir() || ext == "" {
+			continue
+		}
+		e := RegistryEntry{
+			Name: strings.TrimSuffix(entry.Name(), ext),
+			File: filepath.Join(r.Dir, entry.Name()),
+		}
+		e.Manifest, e.Err = VerifyPluginBundle(e.File)
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// Install verifies a plugin bundle and copies it into the registry,
+// replacing the installed bundle of the same name
+func (r *PluginRegistry) Install(fn string) (*RegistryEntry, error) {
+	ext := PluginBundleExt(fn)
+	if ext == "" {
+		return nil, fmt.Errorf("%s: not a plugin bundle, expect %s",
+			fn, strings.Join(PluginBundleExts, ", "))
+	}
+	mf, err := VerifyPluginBundle(fn)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	name := mf.Name
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(fn), ext)
+	}
+	if err = checkPluginName(name); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	raw, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(r.Dir, 0755); err != nil {
+		return nil, err
+	}
+	if err = r.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	dst := filepath.Join(r.Dir, name+strings.ToLower(ext))
+	tmp := dst + ".tmp"
+	if err = os.WriteFile(tmp, raw, 0644); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	return &RegistryEntry{Name: name, File: dst, Manifest: mf}, nil
+}
+
+// Remove removes an installed plugin bundle
+func (r *PluginRegistry) Remove(name string) error {
+	if err := checkPluginName(name); err != nil {
+		return err
+	}
+	list, err := r.List()
+	if err != nil {
+		return err
+	}
+	for _, e := range list {
+		if e.Name == name || (e.Manifest != nil && e.Manifest.Name == name) {
+			return os.Remove(e.File)
+		}
+	}
+	return fmt.Errorf("plugin %s: %w", name, fs.ErrNotExist)
+}
+
+// checkPluginName rejects names which can't be a file name in the
+// registry, as names come from untrusted bundle manifests
+func checkPluginName(name string) error {
+	if name == "" || name == "." || strings.Contains(name, "..") ||
+		strings.ContainsAny(name, `/\`) || filepath.Base(name) != name {
+		return fmt.Errorf("invalid plugin name %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package vis
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	logger "github.com/op/go-logging"
+	"github.com/rs/xid"
+)
+
+// ClientQueueSize is the maximum number of pending batches per WebSocket
+// client, a client falling behind further is disconnected
+const ClientQueueSize = 256
+
+// Transports of clients
+const (
+	TransportWebSocket = "websocket"
+	TransportSSE       = "sse"
+)
+
+// ClientInfo describes a connected WebSocket or Server-Sent Events client
+type ClientInfo struct {
+	ID           string    `json:"id"`
+	Transport    string    `json:"transport"`
+	RemoteAddr   string    `json:"remote-addr"`
+	ConnectedAt  time.Time `json:"connected-at"`
+	BytesSent    uint64    `json:"bytes-sent"`
+	MessagesSent uint64    `json:"messages-sent"`
+	QueueDepth   int       `json:"queue-depth"`
+}
+
+type wsBatch struct {
+	data  []byte
+	count int
+}
+
+// clientConn writes batches of encoded messages to a client
+type clientConn interface {
+	Write([]byte) (int, error)
+	Close() error
+}
+
+type wsClient struct {
+	id          string
+	conn        clientConn
+	transport   string
+	remoteAddr  string
+	connectedAt time.Time
+	metrics     *Metrics
+
+	queue     chan wsBatch
+	done      chan struct{}
+	closeOnce sync.Once
+
+	bytesSent    uint64
+	messagesSent uint64
+}
+
+func newWsClient(conn clientConn, transport, remoteAddr string, metrics *Metrics) *wsClient {
+	return &wsClient{
+		id:          xid.New().String(),
+		conn:        conn,
+		transport:   transport,
+		remoteAddr:  remoteAddr,
+		connectedAt: time.Now(),
+		metrics:     metrics,
+		queue:       make(chan wsBatch, ClientQueueSize),
+		done:        make(chan struct{}),
+	}
+}
+
+// send queues a batch of encoded messages, it returns false if the
+// queue is full and the client is disconnected
+func (c *wsClient) send(data []byte, count int) bool {
+	if c.closed() {
+		return true
+	}
+	select {
+	case c.queue <- wsBatch{data: data, count: count}:
+		return true
+	default:
+		c.close()
+		return false
+	}
+}
+
+func (c *wsClient) run(log *logger.Logger) {
+	for {
+		select {
+		case <-c.done:
+			return
+		case batch := <-c.queue:
+			start := time.Now()
+			n, err := c.conn.Write(batch.data)
+			c.metrics.BroadcastDuration.ObserveSince(start)
+			atomic.AddUint64(&c.bytesSent, uint64(n))
+			c.metrics.BytesSent.Add(uint64(n))
+			if err != nil {
+				log.Errorf("Write error: %v", err)
+				c.close()
+				return
+			}
+			atomic.AddUint64(&c.messagesSent, uint64(batch.count))
+		}
+	}
+}
+
+func (c *wsClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func (c *wsClient) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *wsClient) info() ClientInfo {
+	return ClientInfo{
+		ID:           c.id,
+		Transport:    c.transport,
+		RemoteAddr:   c.remoteAddr,
+		ConnectedAt:  c.connectedAt,
+		BytesSent:    atomic.LoadUint64(&c.bytesSent),
+		MessagesSent: atomic.LoadUint64(&c.messagesSent),
+		QueueDepth:   len(c.queue),
+	}
+}
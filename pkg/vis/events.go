@@ -0,0 +1,140 @@
+package vis
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SSEKeepAliveInterval is the interval of comments keeping idle
+// Server-Sent Events connections open through proxies
+const SSEKeepAliveInterval = 30 * time.Second
+
+// sseConn writes batches of messages as Server-Sent Events, it must not
+// write after the handler returns, so Close waits for a write in progress
+type sseConn struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	done    chan struct{}
+	closed  bool
+	lock    sync.Mutex
+}
+
+func (c *sseConn) Write(data []byte) (int, error) {
+	return c.write("data: %s\n\n", data)
+}
+
+func (c *sseConn) keepAlive() error {
+	_, err := c.write(": keep-alive\n\n")
+	return err
+}
+
+func (c *sseConn) write(format string, args ...interface{}) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := fmt.Fprintf(c.w, format, args...)
+	c.flusher.Flush()
+	return n, err
+}
+
+func (c *sseConn) Close() error {
+	c.lock.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+	c.lock.Unlock()
+	return nil
+}
+
+// EventsHandler serves /events:
+//
+//	GET   streams the same batches of messages as WebSocket clients
+//	      receive, as Server-Sent Events
+//	POST  sends batches of events to the message sink, like events
+//	      from browsers
+func (s *Server) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.serveSSE(w, r)
+	case http.MethodPost:
+		decoder := NewMsgDecoder(r.Body)
+		for {
+			msgs, err := decoder.Decode()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			s.recvEvents(msgs)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "only GET and POST are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) serveSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	conn := &sseConn{w: w, flusher: flusher, done: make(chan struct{})}
+	client := s.addConn(conn, TransportSSE, r.RemoteAddr)
+	defer s.rmConn(client)
+	if err := s.sendSnapshot(client); err != nil {
+		s.Logger.Errorf("States error: %v", err)
+		return
+	}
+	ticker := time.NewTicker(SSEKeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-conn.done:
+			return
+		case <-ticker.C:
+			if conn.keepAlive() != nil {
+				return
+			}
+		}
+	}
+}
+
+// StreamHandler serves POST /stream, a continuous body of batches of
+// messages, like a chunked request, handled as from a message source
+func (s *Server) StreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	decoder := NewMsgDecoder(r.Body)
+	for {
+		msgs, err := decoder.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			s.metrics().SourceDecodeError("http")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.metrics().SourceReceived("http", msgs)
+		s.RecvMessages(msgs)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -99,6 +99,29 @@ func ObjectMsg(obj Object) Msg {
 	}
 }
 
+// ErrorMsg creates a message reporting an error of a source to browsers,
+// an empty detail clears the error
+func ErrorMsg(source, detail string) Msg {
+	msg := Msg{PropAction: ActionError, PropSource: source}
+	if detail != "" {
+		msg[PropDetail] = detail
+	}
+	return msg
+}
+
+// StatusMsg creates a message reporting connection status of a source
+func StatusMsg(source string, connected bool, detail string) Msg {
+	msg := Msg{
+		PropAction:    ActionStatus,
+		PropSource:    source,
+		PropConnected: connected,
+	}
+	if detail != "" {
+		msg[PropDetail] = detail
+	}
+	return msg
+}
+
 // MustEncode encodes data to JSON
 func MustEncode(data interface{}) []byte {
 	encoded, err := json.Marshal(data)
@@ -148,16 +171,23 @@ type MsgSource interface {
 
 // Properties and Action names
 const (
-	PropAction   = "action"
-	PropObject   = "object"
-	PropValue    = "value"
-	PropData     = "data"
-	PropID       = "id"
-	ActionReset  = "reset"
-	ActionObject = "object"
-	ActionData   = "data"
-	ActionAsset  = "asset"
-	ActionRemove = "remove"
+	PropAction    = "action"
+	PropObject    = "object"
+	PropValue     = "value"
+	PropData      = "data"
+	PropID        = "id"
+	PropSource    = "source"
+	PropConnected = "connected"
+	PropDetail    = "detail"
+	PropToken     = "token"
+	ActionReset   = "reset"
+	ActionObject  = "object"
+	ActionData    = "data"
+	ActionAsset   = "asset"
+	ActionRemove  = "remove"
+	ActionReload  = "reload"
+	ActionStatus  = "status"
+	ActionError   = "error"
 )
 
 // MsgDecoder decodes message from a stream
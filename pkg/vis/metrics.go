@@ -0,0 +1,318 @@
+package vis
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MetricsContentType is the content type of Prometheus text format
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are histogram buckets in seconds
+var DefaultBuckets = []float64{
+	0.0001, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1,
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	value uint64
+}
+
+// Add increases the counter
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+// Inc increases the counter by 1
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Value returns current value of the counter
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// CounterVec is a set of counters partitioned by a single label
+type CounterVec struct {
+	Label string
+
+	lock     sync.RWMutex
+	counters map[string]*Counter
+}
+
+// With returns the counter of the label value
+func (v *CounterVec) With(value string) *Counter {
+	v.lock.RLock()
+	c := v.counters[value]
+	v.lock.RUnlock()
+	if c != nil {
+		return c
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.counters == nil {
+		v.counters = make(map[string]*Counter)
+	}
+	if c = v.counters[value]; c == nil {
+		c = &Counter{}
+		v.counters[value] = c
+	}
+	return c
+}
+
+// Values returns a snapshot of all counters
+func (v *CounterVec) Values() map[string]uint64 {
+	values := make(map[string]uint64)
+	v.lock.RLock()
+	for value, c := range v.counters {
+		values[value] = c.Value()
+	}
+	v.lock.RUnlock()
+	return values
+}
+
+// Histogram samples observations into buckets
+type Histogram struct {
+	Buckets []float64
+
+	lock   sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Observe adds one observation
+func (h *Histogram) Observe(v float64) {
+	h.lock.Lock()
+	if h.counts == nil {
+		h.counts = make([]uint64, len(h.Buckets))
+	}
+	for n, b := range h.Buckets {
+		if v <= b {
+			h.counts[n]++
+		}
+	}
+	h.count++
+	h.sum += v
+	h.lock.Unlock()
+}
+
+// ObserveSince observes the elapsed time in seconds
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *Histogram) snapshot() (counts []uint64, count uint64, sum float64) {
+	h.lock.Lock()
+	counts = make([]uint64, len(h.Buckets))
+	copy(counts, h.counts)
+	count, sum = h.count, h.sum
+	h.lock.Unlock()
+	return
+}
+
+// Metrics collects statistics of the message pipeline
+type Metrics struct {
+	// Messages handled by Server, by action
+	Messages CounterVec
+	// Messages failed in Server, by action
+	MessageErrors CounterVec
+	// Messages received from sources, by source
+	SourceMessages CounterVec
+	// Decode errors in sources, by source
+	DecodeErrors CounterVec
+	// Time spent in Server.RecvMessages
+	RecvDuration Histogram
+	// Time spent writing batches of messages to clients
+	BroadcastDuration Histogram
+	// Bytes written to WebSocket clients
+	BytesSent Counter
+	// Messages received from WebSocket clients
+	EventsReceived Counter
+}
+
+// NewMetrics creates a Metrics
+func NewMetrics() *Metrics {
+	m := &Metrics{}
+	m.Messages.Label = "action"
+	m.MessageErrors.Label = "action"
+	m.SourceMessages.Label = "source"
+	m.DecodeErrors.Label = "source"
+	m.RecvDuration.Buckets = DefaultBuckets
+	m.BroadcastDuration.Buckets = DefaultBuckets
+	return m
+}
+
+// DefaultMetrics is used by Server and message sources unless
+// Server.Metrics is set
+var DefaultMetrics = NewMetrics()
+
+// SinkMetrics returns the metrics message sources record into when
+// sending messages to the sink, which is Server.Metrics for a Server
+func SinkMetrics(sink MessageSink) *Metrics {
+	if p, ok := sink.(interface{ SourceMetrics() *Metrics }); ok {
+		return p.SourceMetrics()
+	}
+	return DefaultMetrics
+}
+
+// SourceReceived records messages received by a source
+func (m *Metrics) SourceReceived(source string, msgs []Msg) {
+	m.SourceMessages.With(source).Add(uint64(len(msgs)))
+}
+
+// SourceDecodeError records a decode error in a source
+func (m *Metrics) SourceDecodeError(source string) {
+	m.DecodeErrors.With(source).Inc()
+}
+
+// MetricsWriter writes metrics in Prometheus text format
+type MetricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+// NewMetricsWriter creates a MetricsWriter
+func NewMetricsWriter(w io.Writer) *MetricsWriter {
+	return &MetricsWriter{w: w}
+}
+
+// Err returns the first write error
+func (w *MetricsWriter) Err() error {
+	return w.err
+}
+
+func (w *MetricsWriter) printf(format string, args ...interface{}) {
+	if w.err == nil {
+		_, w.err = fmt.Fprintf(w.w, format, args...)
+	}
+}
+
+func (w *MetricsWriter) header(name, help, typ string) {
+	w.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// Counter writes a counter
+func (w *MetricsWriter) Counter(name, help string, c *Counter) {
+	w.header(name, help, "counter")
+	w.printf("%s %d\n", name, c.Value())
+}
+
+// CounterVec writes a labeled counter
+func (w *MetricsWriter) CounterVec(name, help string, v *CounterVec) {
+	w.header(name, help, "counter")
+	values := v.Values()
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		w.printf("%s{%s=\"%s\"} %d\n", name, v.Label, escapeLabel(key), values[key])
+	}
+}
+
+// Gauge writes a gauge
+func (w *MetricsWriter) Gauge(name, help string, value float64) {
+	w.header(name, help, "gauge")
+	w.printf("%s %s\n", name, formatFloat(value))
+}
+
+// Histogram writes a histogram
+func (w *MetricsWriter) Histogram(name, help string, h *Histogram) {
+	w.header(name, help, "histogram")
+	counts, count, sum := h.snapshot()
+	for n, b := range h.Buckets {
+		w.printf("%s_bucket{le=\"%s\"} %d\n", name, formatFloat(b), counts[n])
+	}
+	w.printf("%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	w.printf("%s_sum %s\n", name, formatFloat(sum))
+	w.printf("%s_count %d\n", name, count)
+}
+
+// WriteTo writes all pipeline metrics
+func (m *Metrics) WriteTo(w *MetricsWriter) {
+	w.CounterVec("see_messages_total", "Messages handled by the server.", &m.Messages)
+	w.CounterVec("see_message_errors_total", "Messages failed to be handled by the server.", &m.MessageErrors)
+	w.CounterVec("see_source_messages_total", "Messages received from message sources.", &m.SourceMessages)
+	w.CounterVec("see_source_decode_errors_total", "Decode errors in message sources.", &m.DecodeErrors)
+	w.Histogram("see_recv_duration_seconds", "Time spent handling a batch of messages.", &m.RecvDuration)
+	w.Histogram("see_broadcast_duration_seconds", "Time spent writing a batch of messages to a client.", &m.BroadcastDuration)
+	w.Counter("see_websocket_sent_bytes_total", "Bytes sent to WebSocket clients.", &m.BytesSent)
+	w.Counter("see_websocket_events_total", "Events received from WebSocket clients.", &m.EventsReceived)
+}
+
+func escapeLabel(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return strings.ReplaceAll(s, `"`, `\"`)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// MetricsHandler is the http handler exposing metrics
+func (s *Server) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", MetricsContentType)
+	mw := NewMetricsWriter(w)
+	s.metrics().WriteTo(mw)
+
+	clients := make(map[string]int)
+	s.connsLock.RLock()
+	for _, c := range s.conns {
+		clients[c.transport]++
+	}
+	s.connsLock.RUnlock()
+	mw.Gauge("see_websocket_clients", "Connected WebSocket clients.", float64(clients[TransportWebSocket]))
+	mw.Gauge("see_sse_clients", "Connected Server-Sent Events clients.", float64(clients[TransportSSE]))
+
+	if objs, err := s.Objects(); err == nil {
+		mw.Gauge("see_objects", "Objects in the state store.", float64(len(objs)))
+	}
+	if vals, err := s.DataValues(); err == nil {
+		mw.Gauge("see_data_values", "Data values in the state store.", float64(len(vals)))
+	}
+
+	var assets, assetBytes int
+	s.assetsLock.RLock()
+	for _, a := range s.assets {
+		assets++
+		assetBytes += len(a.data)
+	}
+	s.assetsLock.RUnlock()
+	mw.Gauge("see_assets", "Assets held by the server.", float64(assets))
+	mw.Gauge("see_asset_bytes", "Total size of assets held by the server.", float64(assetBytes))
+}
+
+// SourceMetrics returns the metrics for message sources sending to
+// the server, see SinkMetrics
+func (s *Server) SourceMetrics() *Metrics {
+	return s.metrics()
+}
+
+func (s *Server) metrics() *Metrics {
+	if s.Metrics != nil {
+		return s.Metrics
+	}
+	return DefaultMetrics
+}
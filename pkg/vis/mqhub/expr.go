@@ -0,0 +1,719 @@
+package mqhub
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/robotalks/see/pkg/vis"
+)
+
+// Func is a function callable from expressions
+type Func func(args ...interface{}) (interface{}, error)
+
+// Env provides variables and functions for evaluating expressions.
+// Values are JSON-like: nil, bool, float64, string, []interface{}
+// and map[string]interface{}.
+type Env struct {
+	Vars  map[string]interface{}
+	Funcs map[string]Func
+	// Track is optionally called with the names of variables used, and
+	// the member if only a member is used, for tracking dependencies
+	Track func(name, member string)
+}
+
+// Expr is a compiled expression. Operators, from low to high precedence:
+//
+//	a ? b : c     conditional
+//	a ?? b        b if a is null
+//	||  &&        logical or, and
+//	==  !=        equality
+//	<  <=  >  >=  comparison
+//	+  -          add (concatenates strings), subtract
+//	*  /  %       multiply, divide, modulo
+//	!  -          not, negate
+//	a.b  a[b]  f(a, b)
+//
+// Literals are numbers, 'single' or "double" quoted strings, true, false
+// and null. Accessing members of null is null, so missing states
+// don't fail until used in arithmetic.
+type Expr struct {
+	src  string
+	root exprNode
+}
+
+// CompileExpr compiles an expression
+func CompileExpr(src string) (*Expr, error) {
+	p := &exprParser{src: src}
+	if err := p.scan(); err != nil {
+		return nil, err
+	}
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, p.errorf(tok, "unexpected %s", tok.text)
+	}
+	return &Expr{src: src, root: root}, nil
+}
+
+// String returns the source of the expression
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Eval evaluates the expression
+func (e *Expr) Eval(env *Env) (interface{}, error) {
+	return e.root.eval(env)
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+	num  float64
+	str  string
+}
+
+// operators sorted to match the longest first
+var exprOps = []string{
+	"??", "||", "&&", "==", "!=", "<=", ">=",
+	"?", ":", "<", ">", "+", "-", "*", "/", "%", "!", ".", ",", "(", ")", "[", "]",
+}
+
+type exprParser struct {
+	src    string
+	tokens []token
+	next   int
+}
+
+func (p *exprParser) errorf(tok token, format string, args ...interface{}) error {
+	return fmt.Errorf("%s at %d: %s", p.src, tok.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *exprParser) scan() error {
+	src := p.src
+	for pos := 0; pos < len(src); {
+		c := src[pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			pos++
+		case c >= '0' && c <= '9' || (c == '.' && pos+1 < len(src) && src[pos+1] >= '0' && src[pos+1] <= '9'):
+			end := pos
+			for end < len(src) && (strings.IndexByte("0123456789.eE", src[end]) >= 0 ||
+				((src[end] == '+' || src[end] == '-') && (src[end-1] == 'e' || src[end-1] == 'E'))) {
+				end++
+			}
+			num, err := strconv.ParseFloat(src[pos:end], 64)
+			if err != nil {
+				return fmt.Errorf("%s at %d: invalid number %s", src, pos+1, src[pos:end])
+			}
+			p.tokens = append(p.tokens, token{kind: tokNumber, text: src[pos:end], pos: pos, num: num})
+			pos = end
+		case c == '"' || c == '\'':
+			str, end, err := scanString(src, pos)
+			if err != nil {
+				return err
+			}
+			p.tokens = append(p.tokens, token{kind: tokString, text: src[pos:end], pos: pos, str: str})
+			pos = end
+		case c == '_' || unicode.IsLetter(rune(c)):
+			end := pos + 1
+			for end < len(src) && (src[end] == '_' ||
+				unicode.IsLetter(rune(src[end])) || unicode.IsDigit(rune(src[end]))) {
+				end++
+			}
+			p.tokens = append(p.tokens, token{kind: tokIdent, text: src[pos:end], pos: pos})
+			pos = end
+		default:
+			matched := ""
+			for _, op := range exprOps {
+				if strings.HasPrefix(src[pos:], op) {
+					matched = op
+					break
+				}
+			}
+			if matched == "" {
+				return fmt.Errorf("%s at %d: unexpected %q", src, pos+1, c)
+			}
+			p.tokens = append(p.tokens, token{kind: tokOp, text: matched, pos: pos})
+			pos += len(matched)
+		}
+	}
+	p.tokens = append(p.tokens, token{kind: tokEOF, text: "end of expression", pos: len(src)})
+	return nil
+}
+
+// scanString scans a quoted string starting at pos, and returns the
+// unquoted string and the position after the closing quote
+func scanString(src string, pos int) (string, int, error) {
+	quote := src[pos]
+	var sb strings.Builder
+	for end := pos + 1; end < len(src); end++ {
+		c := src[end]
+		switch {
+		case c == quote:
+			return sb.String(), end + 1, nil
+		case c == '\\' && end+1 < len(src):
+			end++
+			switch c = src[end]; c {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'r':
+				sb.WriteByte('\r')
+			default:
+				sb.WriteByte(c)
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", len(src), fmt.Errorf("%s at %d: unterminated string", src, pos+1)
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.next]
+}
+
+func (p *exprParser) take() token {
+	tok := p.tokens[p.next]
+	if tok.kind != tokEOF {
+		p.next++
+	}
+	return tok
+}
+
+func (p *exprParser) isOp(ops ...string) bool {
+	tok := p.peek()
+	if tok.kind != tokOp {
+		return false
+	}
+	for _, op := range ops {
+		if tok.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *exprParser) expect(op string) error {
+	if tok := p.take(); tok.kind != tokOp || tok.text != op {
+		return p.errorf(tok, "expect %s, got %s", op, tok.text)
+	}
+	return nil
+}
+
+// binaryLevels lists binary operators from low to high precedence
+var binaryLevels = [][]string{
+	{"??"},
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *exprParser) parseExpr() (exprNode, error) {
+	cond, err := p.parseBinary(0)
+	if err != nil || !p.isOp("?") {
+		return cond, err
+	}
+	p.take()
+	yes, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if err = p.expect(":"); err != nil {
+		return nil, err
+	}
+	no, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	return &condNode{cond: cond, yes: yes, no: no}, nil
+}
+
+func (p *exprParser) parseBinary(level int) (exprNode, error) {
+	if level >= len(binaryLevels) {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp(binaryLevels[level]...) {
+		op := p.take().text
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.isOp("!", "-") {
+		op := p.take().text
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: op, operand: operand}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *exprParser) parsePostfix() (exprNode, error) {
+	node, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.isOp("."):
+			p.take()
+			tok := p.take()
+			if tok.kind != tokIdent {
+				return nil, p.errorf(tok, "expect member name, got %s", tok.text)
+			}
+			node = &memberNode{target: node, key: &literalNode{val: tok.text}}
+		case p.isOp("["):
+			p.take()
+			key, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect("]"); err != nil {
+				return nil, err
+			}
+			node = &memberNode{target: node, key: key}
+		default:
+			return node, nil
+		}
+	}
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	tok := p.take()
+	switch tok.kind {
+	case tokNumber:
+		return &literalNode{val: tok.num}, nil
+	case tokString:
+		return &literalNode{val: tok.str}, nil
+	case tokIdent:
+		switch tok.text {
+		case "true":
+			return &literalNode{val: true}, nil
+		case "false":
+			return &literalNode{val: false}, nil
+		case "null", "nil":
+			return &literalNode{val: nil}, nil
+		}
+		if !p.isOp("(") {
+			return &identNode{name: tok.text}, nil
+		}
+		p.take()
+		call := &callNode{name: tok.text}
+		for !p.isOp(")") {
+			arg, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			if !p.isOp(",") {
+				break
+			}
+			p.take()
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return call, nil
+	case tokOp:
+		if tok.text == "(" {
+			node, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect(")"); err != nil {
+				return nil, err
+			}
+			return node, nil
+		}
+	}
+	return nil, p.errorf(tok, "unexpected %s", tok.text)
+}
+
+type exprNode interface {
+	eval(env *Env) (interface{}, error)
+}
+
+type literalNode struct {
+	val interface{}
+}
+
+func (n *literalNode) eval(*Env) (interface{}, error) {
+	return n.val, nil
+}
+
+type identNode struct {
+	name string
+}
+
+func (n *identNode) eval(env *Env) (interface{}, error) {
+	if env.Track != nil {
+		env.Track(n.name, "")
+	}
+	return env.Vars[n.name], nil
+}
+
+type memberNode struct {
+	target exprNode
+	key    exprNode
+}
+
+func (n *memberNode) eval(env *Env) (interface{}, error) {
+	key, err := n.key.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	var target interface{}
+	if ident, ok := n.target.(*identNode); ok && env.Track != nil {
+		// only the member of the variable is used
+		env.Track(ident.name, toString(key))
+		target = env.Vars[ident.name]
+	} else if target, err = n.target.eval(env); err != nil {
+		return nil, err
+	}
+	return member(target, key)
+}
+
+// member gets a member of a map or an element of a list
+func member(target, key interface{}) (interface{}, error) {
+	switch t := target.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		return t[toString(key)], nil
+	case vis.Object:
+		return t[toString(key)], nil
+	case []interface{}:
+		index, ok := key.(float64)
+		if !ok {
+			return nil, fmt.Errorf("list index %v is not a number", key)
+		}
+		if index < 0 {
+			index += float64(len(t))
+		}
+		if index < 0 || int(index) >= len(t) {
+			return nil, nil
+		}
+		return t[int(index)], nil
+	}
+	return nil, fmt.Errorf("cannot get %v of %s", key, typeName(target))
+}
+
+type callNode struct {
+	name string
+	args []exprNode
+}
+
+func (n *callNode) eval(env *Env) (interface{}, error) {
+	fn := env.Funcs[n.name]
+	if fn == nil {
+		return nil, fmt.Errorf("unknown function %s", n.name)
+	}
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		val, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = val
+	}
+	val, err := fn(args...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", n.name, err)
+	}
+	return val, nil
+}
+
+type unaryNode struct {
+	op      string
+	operand exprNode
+}
+
+func (n *unaryNode) eval(env *Env) (interface{}, error) {
+	val, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		return !truthy(val), nil
+	}
+	num, err := toNumber(val)
+	if err != nil {
+		return nil, err
+	}
+	return -num, nil
+}
+
+type condNode struct {
+	cond, yes, no exprNode
+}
+
+func (n *condNode) eval(env *Env) (interface{}, error) {
+	cond, err := n.cond.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if truthy(cond) {
+		return n.yes.eval(env)
+	}
+	return n.no.eval(env)
+}
+
+type binaryNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n *binaryNode) eval(env *Env) (interface{}, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	// short circuits
+	switch n.op {
+	case "??":
+		if left != nil {
+			return left, nil
+		}
+		return n.right.eval(env)
+	case "||":
+		if truthy(left) {
+			return true, nil
+		}
+		right, err := n.right.eval(env)
+		return truthy(right), err
+	case "&&":
+		if !truthy(left) {
+			return false, nil
+		}
+		right, err := n.right.eval(env)
+		return truthy(right), err
+	}
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "<", "<=", ">", ">=":
+		return compare(n.op, left, right)
+	case "+":
+		if ls, ok := left.(string); ok {
+			return ls + toString(right), nil
+		}
+		if rs, ok := right.(string); ok {
+			return toString(left) + rs, nil
+		}
+	}
+	return arithmetic(n.op, left, right)
+}
+
+func arithmetic(op string, left, right interface{}) (interface{}, error) {
+	l, err := toNumber(left)
+	if err != nil {
+		return nil, err
+	}
+	r, err := toNumber(right)
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return l / r, nil
+	case "%":
+		if r == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return math.Mod(l, r), nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", op)
+}
+
+func compare(op string, left, right interface{}) (interface{}, error) {
+	var cmp int
+	ls, lstr := left.(string)
+	rs, rstr := right.(string)
+	if lstr && rstr {
+		cmp = strings.Compare(ls, rs)
+	} else {
+		l, err := toNumber(left)
+		if err != nil {
+			return nil, err
+		}
+		r, err := toNumber(right)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case l < r:
+			cmp = -1
+		case l > r:
+			cmp = 1
+		}
+	}
+	switch op {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	}
+	return cmp >= 0, nil
+}
+
+func equal(left, right interface{}) bool {
+	if l, err := toNumber(left); err == nil && isNumber(left) {
+		if r, err := toNumber(right); err == nil && isNumber(right) {
+			return l == r
+		}
+	}
+	return reflect.DeepEqual(normalizeValue(left), normalizeValue(right))
+}
+
+// normalizeValue converts numbers to float64 and named maps to plain maps
+func normalizeValue(val interface{}) interface{} {
+	if isNumber(val) {
+		num, _ := toNumber(val)
+		return num
+	}
+	if obj, ok := val.(vis.Object); ok {
+		return map[string]interface{}(obj)
+	}
+	return val
+}
+
+func isNumber(val interface{}) bool {
+	switch val.(type) {
+	case float64, float32, int, int64, int32, uint, uint64, uint32:
+		return true
+	}
+	return false
+}
+
+func toNumber(val interface{}) (float64, error) {
+	switch v := val.(type) {
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case uint:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case uint32:
+		return float64(v), nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		if num, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+			return num, nil
+		}
+	}
+	return 0, fmt.Errorf("%s is not a number", typeName(val))
+}
+
+func truthy(val interface{}) bool {
+	switch v := val.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	}
+	if isNumber(val) {
+		num, _ := toNumber(val)
+		return num != 0
+	}
+	return true
+}
+
+// toString formats a value for string concatenation and interpolation
+func toString(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	if isNumber(val) {
+		num, _ := toNumber(val)
+		return strconv.FormatFloat(num, 'f', -1, 64)
+	}
+	return string(vis.MustEncode(val))
+}
+
+func typeName(val interface{}) string {
+	switch val.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case string:
+		return fmt.Sprintf("string %q", val)
+	case []interface{}:
+		return "list"
+	case map[string]interface{}, vis.Object:
+		return "map"
+	}
+	if isNumber(val) {
+		return "number"
+	}
+	return fmt.Sprintf("%T", val)
+}
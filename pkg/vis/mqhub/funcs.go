@@ -0,0 +1,422 @@
+package mqhub
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// libFuncs is the function library shared by object and action
+// templates and expressions. See README for the documentation.
+var libFuncs = map[string]Func{
+	// math
+	"min":      numFunc(-2, func(x []float64) float64 { return fold(x, math.Min) }),
+	"max":      numFunc(-2, func(x []float64) float64 { return fold(x, math.Max) }),
+	"clamp":    numFunc(3, func(x []float64) float64 { return math.Max(x[1], math.Min(x[2], x[0])) }),
+	"deadzone": numFunc(2, deadzone),
+	"abs":      numFunc(1, func(x []float64) float64 { return math.Abs(x[0]) }),
+	"floor":    numFunc(1, func(x []float64) float64 { return math.Floor(x[0]) }),
+	"ceil":     numFunc(1, func(x []float64) float64 { return math.Ceil(x[0]) }),
+	"round":    numFunc(-1, round),
+	"sqrt":     numFunc(1, func(x []float64) float64 { return math.Sqrt(x[0]) }),
+	"pow":      numFunc(2, func(x []float64) float64 { return math.Pow(x[0], x[1]) }),
+	"hypot":    numFunc(2, func(x []float64) float64 { return math.Hypot(x[0], x[1]) }),
+	"sin":      numFunc(1, func(x []float64) float64 { return math.Sin(x[0]) }),
+	"cos":      numFunc(1, func(x []float64) float64 { return math.Cos(x[0]) }),
+	"tan":      numFunc(1, func(x []float64) float64 { return math.Tan(x[0]) }),
+	"asin":     numFunc(1, func(x []float64) float64 { return math.Asin(x[0]) }),
+	"acos":     numFunc(1, func(x []float64) float64 { return math.Acos(x[0]) }),
+	"atan":     numFunc(1, func(x []float64) float64 { return math.Atan(x[0]) }),
+	"atan2":    numFunc(2, func(x []float64) float64 { return math.Atan2(x[0], x[1]) }),
+	"deg":      numFunc(1, func(x []float64) float64 { return x[0] * 180 / math.Pi }),
+	"rad":      numFunc(1, func(x []float64) float64 { return x[0] * math.Pi / 180 }),
+	"scalef":   numFunc(2, func(x []float64) float64 { return x[0] * x[1] }),
+	"scalei":   intFunc(numFunc(2, func(x []float64) float64 { return x[0] * x[1] })),
+	"int":      intFunc(numFunc(1, func(x []float64) float64 { return x[0] })),
+	"float":    numFunc(1, func(x []float64) float64 { return x[0] }),
+	"convert":  convert,
+
+	// values and strings
+	"default": fnDefault,
+	"json":    fnJSON,
+	"quote":   fnQuote,
+	"str":     fnStr,
+	"b64enc":  fnB64Enc,
+	"b64dec":  fnB64Dec,
+
+	// time
+	"now":        fnNow,
+	"formatTime": fnFormatTime,
+
+	// matching
+	"matches": fnMatches,
+	"exists":  fnExists,
+	"between": fnBetween,
+	"in":      fnIn,
+}
+
+// ctxFuncs creates functions accessing the Context, it must be called
+// with lock held. track is called with states used.
+func ctxFuncs(c *Context, track func(id, endpoint string)) map[string]Func {
+	funcs := make(map[string]Func, len(libFuncs)+2)
+	for name, fn := range libFuncs {
+		funcs[name] = fn
+	}
+	funcs["object"] = func(args ...interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("expect 1 argument")
+		}
+		track(toString(args[0]), "")
+		if obj, ok := c.Objects[toString(args[0])]; ok {
+			return obj, nil
+		}
+		return nil, nil
+	}
+	funcs["state"] = func(args ...interface{}) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("expect 2 arguments")
+		}
+		track(toString(args[0]), toString(args[1]))
+		if s := c.States[toString(args[0])]; s != nil {
+			if val, ok := s[toString(args[1])]; ok {
+				return string(val), nil
+			}
+		}
+		return nil, nil
+	}
+	return funcs
+}
+
+// templateFuncs returns the library for templates. Templates access
+// the Context by passing it as the first argument of object and state,
+// which must be executed with the lock of the Context held.
+func templateFuncs() template.FuncMap {
+	funcs := make(template.FuncMap, len(libFuncs)+2)
+	for name, fn := range libFuncs {
+		funcs[name] = fn
+	}
+	funcs["object"] = func(ctx *Context, id string) interface{} {
+		if obj, ok := ctx.Objects[id]; ok {
+			return obj
+		}
+		return nil
+	}
+	funcs["state"] = func(ctx *Context, id, endpoint string) interface{} {
+		val := ctx.States[id][endpoint]
+		if val == nil {
+			return nil
+		}
+		return string(val)
+	}
+	return funcs
+}
+
+// numFunc wraps a numeric function with n arguments, or at least -n
+// arguments if n is negative
+func numFunc(n int, fn func([]float64) float64) Func {
+	return func(args ...interface{}) (interface{}, error) {
+		if n >= 0 && len(args) != n {
+			return nil, fmt.Errorf("expect %d arguments", n)
+		}
+		if n < 0 && len(args) < -n {
+			return nil, fmt.Errorf("expect at least %d arguments", -n)
+		}
+		nums := make([]float64, len(args))
+		for i, arg := range args {
+			num, err := toNumber(arg)
+			if err != nil {
+				return nil, err
+			}
+			nums[i] = num
+		}
+		return fn(nums), nil
+	}
+}
+
+// intFunc truncates the result to an integer
+func intFunc(fn Func) Func {
+	return func(args ...interface{}) (interface{}, error) {
+		val, err := fn(args...)
+		if err != nil {
+			return nil, err
+		}
+		return int64(val.(float64)), nil
+	}
+}
+
+func fold(x []float64, fn func(a, b float64) float64) float64 {
+	result := x[0]
+	for _, v := range x[1:] {
+		result = fn(result, v)
+	}
+	return result
+}
+
+// deadzone(val, zone) is 0 if |val| < zone, otherwise val scaled so the
+// output still covers the full range from 0 to 1
+func deadzone(x []float64) float64 {
+	val, zone := x[0], math.Abs(x[1])
+	if math.Abs(val) < zone || zone >= 1 {
+		return 0
+	}
+	return math.Copysign((math.Abs(val)-zone)/(1-zone), val)
+}
+
+// round(val) rounds to integer, round(val, digits) to decimal digits
+func round(x []float64) float64 {
+	if len(x) == 1 {
+		return math.Round(x[0])
+	}
+	scale := math.Pow(10, x[1])
+	return math.Round(x[0]*scale) / scale
+}
+
+// units maps a unit to its factor of the base unit of the same kind
+var units = map[string]struct {
+	kind   string
+	factor float64
+}{
+	"m":     {"length", 1},
+	"km":    {"length", 1000},
+	"cm":    {"length", 0.01},
+	"mm":    {"length", 0.001},
+	"in":    {"length", 0.0254},
+	"ft":    {"length", 0.3048},
+	"mi":    {"length", 1609.344},
+	"rad":   {"angle", 1},
+	"deg":   {"angle", math.Pi / 180},
+	"rev":   {"angle", 2 * math.Pi},
+	"s":     {"time", 1},
+	"ms":    {"time", 0.001},
+	"us":    {"time", 0.000001},
+	"min":   {"time", 60},
+	"h":     {"time", 3600},
+	"m/s":   {"speed", 1},
+	"km/h":  {"speed", 1000.0 / 3600},
+	"mph":   {"speed", 1609.344 / 3600},
+	"rpm":   {"angular-speed", 2 * math.Pi / 60},
+	"rad/s": {"angular-speed", 1},
+	"deg/s": {"angular-speed", math.Pi / 180},
+	"kg":    {"mass", 1},
+	"g":     {"mass", 0.001},
+	"lb":    {"mass", 0.45359237},
+}
+
+// convert(val, from, to) converts val between units of the same kind
+func convert(args ...interface{}) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, fmt.Errorf("expect 3 arguments")
+	}
+	val, err := toNumber(args[0])
+	if err != nil {
+		return nil, err
+	}
+	fromName, toName := toString(args[1]), toString(args[2])
+	if temp, ok := convertTemperature(val, fromName, toName); ok {
+		return temp, nil
+	}
+	from, ok := units[fromName]
+	if !ok {
+		return nil, fmt.Errorf("unknown unit %s", fromName)
+	}
+	to, ok := units[toName]
+	if !ok {
+		return nil, fmt.Errorf("unknown unit %s", toName)
+	}
+	if from.kind != to.kind {
+		return nil, fmt.Errorf("cannot convert %s to %s", fromName, toName)
+	}
+	return val * from.factor / to.factor, nil
+}
+
+func convertTemperature(val float64, from, to string) (float64, bool) {
+	var celsius float64
+	switch from {
+	case "C":
+		celsius = val
+	case "F":
+		celsius = (val - 32) * 5 / 9
+	case "K":
+		celsius = val - 273.15
+	default:
+		return 0, false
+	}
+	switch to {
+	case "C":
+		return celsius, true
+	case "F":
+		return celsius*9/5 + 32, true
+	case "K":
+		return celsius + 273.15, true
+	}
+	return 0, false
+}
+
+// default(def, val) is def if val is null or empty, with the value last
+// for pipelines in templates like {{.state | default 0}}
+func fnDefault(args ...interface{}) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("expect 2 arguments")
+	}
+	if args[1] == nil || args[1] == "" {
+		return args[0], nil
+	}
+	return args[1], nil
+}
+
+// json(val) encodes val as JSON
+func fnJSON(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expect 1 argument")
+	}
+	encoded, err := json.Marshal(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return string(encoded), nil
+}
+
+// quote(val) formats val as a string and encodes it as a JSON string
+func fnQuote(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expect 1 argument")
+	}
+	return fnJSON(toString(args[0]))
+}
+
+// str(val) formats val as a string
+func fnStr(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expect 1 argument")
+	}
+	return toString(args[0]), nil
+}
+
+func fnB64Enc(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expect 1 argument")
+	}
+	return base64.StdEncoding.EncodeToString([]byte(toString(args[0]))), nil
+}
+
+func fnB64Dec(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expect 1 argument")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(toString(args[0]))
+	if err != nil {
+		return nil, err
+	}
+	return string(decoded), nil
+}
+
+// now() is the current Unix time in seconds
+func fnNow(args ...interface{}) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("expect no arguments")
+	}
+	return float64(time.Now().UnixNano()) / 1e9, nil
+}
+
+// formatTime(layout, t) formats Unix time in seconds or an RFC3339
+// string with a Go time layout, or one of rfc3339, date, time, kitchen
+func fnFormatTime(args ...interface{}) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("expect 2 arguments")
+	}
+	var t time.Time
+	if str, ok := args[1].(string); ok {
+		parsed, err := time.Parse(time.RFC3339Nano, str)
+		if err != nil {
+			return nil, err
+		}
+		t = parsed
+	} else {
+		secs, err := toNumber(args[1])
+		if err != nil {
+			return nil, err
+		}
+		t = time.Unix(0, int64(secs*1e9))
+	}
+	layout := toString(args[0])
+	switch strings.ToLower(layout) {
+	case "rfc3339":
+		layout = time.RFC3339
+	case "date":
+		layout = "2006-01-02"
+	case "time":
+		layout = "15:04:05"
+	case "kitchen":
+		layout = time.Kitchen
+	}
+	return t.Format(layout), nil
+}
+
+// regexps caches compiled patterns of matches
+var regexps sync.Map
+
+// matches(str, pattern) tests str against a regular expression
+func fnMatches(args ...interface{}) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("expect 2 arguments")
+	}
+	pattern := toString(args[1])
+	re, ok := regexps.Load(pattern)
+	if !ok {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		re, _ = regexps.LoadOrStore(pattern, compiled)
+	}
+	if args[0] == nil {
+		return false, nil
+	}
+	return re.(*regexp.Regexp).MatchString(toString(args[0])), nil
+}
+
+// exists(val) is true if val is not null
+func fnExists(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expect 1 argument")
+	}
+	return args[0] != nil, nil
+}
+
+// between(val, min, max) is true if min <= val <= max
+func fnBetween(args ...interface{}) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, fmt.Errorf("expect 3 arguments")
+	}
+	if args[0] == nil {
+		return false, nil
+	}
+	nums := make([]float64, len(args))
+	for i, arg := range args {
+		num, err := toNumber(arg)
+		if err != nil {
+			return nil, err
+		}
+		nums[i] = num
+	}
+	return nums[1] <= nums[0] && nums[0] <= nums[2], nil
+}
+
+// in(val, a, b, ...) is true if val equals any of the rest
+func fnIn(args ...interface{}) (interface{}, error) {
+	if len(args) < 1 {
+		return nil, fmt.Errorf("expect at least 1 argument")
+	}
+	for _, arg := range args[1:] {
+		if equal(args[0], arg) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
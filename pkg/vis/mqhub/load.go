@@ -0,0 +1,288 @@
+package mqhub
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/easeway/langx.go/mapper"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// schemaMapper maps decoded YAML to schema structs by json tags
+var schemaMapper = &mapper.Mapper{FieldTags: []string{"json"}}
+
+// schemaLoader loads schema files following includes and merges them
+type schemaLoader struct {
+	schema    TopSchema
+	renderers []objectsRenderer
+	files     []string
+	// dirs are directories of glob patterns for watching new files
+	dirs []string
+
+	loaded  map[string]bool
+	refresh string
+	states  map[string]string
+	apis    map[string]string
+	muted   map[string]bool
+	actions map[string]string
+	writes  map[string]string
+}
+
+func newSchemaLoader() *schemaLoader {
+	return &schemaLoader{
+		loaded:  make(map[string]bool),
+		states:  make(map[string]string),
+		apis:    make(map[string]string),
+		muted:   make(map[string]bool),
+		actions: make(map[string]string),
+		writes:  make(map[string]string),
+	}
+}
+
+// loadPattern loads files matching a glob pattern, a pattern without
+// wildcards must match an existing file
+func (l *schemaLoader) loadPattern(pattern string) error {
+	if !strings.ContainsAny(pattern, "*?[") {
+		return l.loadFile(pattern)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return fmt.Errorf("%s: %w", pattern, err)
+	}
+	l.dirs = append(l.dirs, filepath.Dir(pattern))
+	sort.Strings(matches)
+	for _, fn := range matches {
+		if err = l.loadFile(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *schemaLoader) loadFile(filename string) error {
+	absPath, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	// a file included more than once is loaded only once
+	if l.loaded[absPath] {
+		return nil
+	}
+	l.loaded[absPath] = true
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	l.files = append(l.files, filename)
+	var doc yaml.Node
+	if err = yaml.Unmarshal(content, &doc); err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s:%d: schema must be a map", filename, root.Line)
+	}
+	for n := 0; n+1 < len(root.Content); n += 2 {
+		key, val := root.Content[n], root.Content[n+1]
+		switch key.Value {
+		case "objects":
+			err = l.addObjects(filename, val)
+		case "refresh":
+			err = l.setRefresh(fmt.Sprintf("%s:%d", filename, val.Line), val)
+		case "states", "mute", "actions", "writable", "include":
+			err = l.addList(filename, key.Value, val)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addObjects adds either a JSON template string or a list of structured
+// object definitions
+func (l *schemaLoader) addObjects(filename string, node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return l.addTemplate(filename, node)
+	case yaml.SequenceNode:
+		return l.addObjectDefs(filename, node)
+	}
+	return fmt.Errorf("%s:%d: objects must be a template string or a list", filename, node.Line)
+}
+
+func (l *schemaLoader) addTemplate(filename string, node *yaml.Node) error {
+	// pad lines so template errors refer to lines in the file
+	line := node.Line
+	if node.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+		line++
+	}
+	t, err := newObjectsTemplate(filename).Parse(strings.Repeat("\n", line-1) + node.Value)
+	if err != nil {
+		return err
+	}
+	l.renderers = append(l.renderers, &templateRenderer{template: t.Templates()[0]})
+	return nil
+}
+
+func (l *schemaLoader) addObjectDefs(filename string, node *yaml.Node) error {
+	r := &defsRenderer{filename: filename}
+	for _, item := range node.Content {
+		source := fmt.Sprintf("%s:%d", filename, item.Line)
+		var raw interface{}
+		if err := item.Decode(&raw); err != nil {
+			return fmt.Errorf("%s: %w", source, err)
+		}
+		def, err := compileObjectDef(source, normalizeMap(raw))
+		if err != nil {
+			return err
+		}
+		r.defs = append(r.defs, def)
+	}
+	l.renderers = append(l.renderers, r)
+	return nil
+}
+
+func (l *schemaLoader) setRefresh(source string, node *yaml.Node) error {
+	if l.refresh != "" {
+		return fmt.Errorf("%s: refresh already defined at %s", source, l.refresh)
+	}
+	sch := &l.schema.Refresh
+	if err := decodeNode(node, sch); err != nil {
+		return fmt.Errorf("%s: %w", source, err)
+	}
+	if err := sch.Init(); err != nil {
+		return fmt.Errorf("%s: refresh: %w", source, err)
+	}
+	l.refresh = source
+	return nil
+}
+
+func (l *schemaLoader) addList(filename, name string, node *yaml.Node) error {
+	if node.Kind != yaml.SequenceNode {
+		return fmt.Errorf("%s:%d: %s must be a list", filename, node.Line, name)
+	}
+	for _, item := range node.Content {
+		source := fmt.Sprintf("%s:%d", filename, item.Line)
+		var err error
+		switch name {
+		case "states":
+			err = l.addState(source, item)
+		case "mute":
+			err = l.addMute(source, item)
+		case "actions":
+			err = l.addAction(source, item)
+		case "writable":
+			err = l.addWritable(source, item)
+		case "include":
+			err = l.include(filename, source, item)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *schemaLoader) addState(source string, node *yaml.Node) error {
+	sch := &StateSchema{}
+	if err := decodeNode(node, sch); err != nil {
+		return fmt.Errorf("%s: %w", source, err)
+	}
+	key := sch.Component + "/" + sch.Endpoint
+	if prev, exist := l.states[key]; exist {
+		return fmt.Errorf("%s: state %s already defined at %s", source, key, prev)
+	}
+	if sch.APIPath != "" {
+		if prev, exist := l.apis[sch.APIPath]; exist {
+			return fmt.Errorf("%s: api-path %s already defined at %s", source, sch.APIPath, prev)
+		}
+		l.apis[sch.APIPath] = source
+	}
+	l.states[key] = source
+	l.schema.States = append(l.schema.States, sch)
+	return nil
+}
+
+func (l *schemaLoader) addMute(source string, node *yaml.Node) error {
+	sch := &MuteSchema{}
+	if err := decodeNode(node, sch); err != nil {
+		return fmt.Errorf("%s: %w", source, err)
+	}
+	// muting the same state twice is harmless
+	if key := sch.Component + "/" + sch.Endpoint; !l.muted[key] {
+		l.muted[key] = true
+		l.schema.Muted = append(l.schema.Muted, sch)
+	}
+	return nil
+}
+
+func (l *schemaLoader) addAction(source string, node *yaml.Node) error {
+	sch := &ActionSchema{}
+	if err := decodeNode(node, sch); err != nil {
+		return fmt.Errorf("%s: %w", source, err)
+	}
+	if err := sch.Init(); err != nil {
+		return fmt.Errorf("%s: %w", source, err)
+	}
+	key := sch.matchKey()
+	if prev, exist := l.actions[key]; exist {
+		return fmt.Errorf("%s: action %s with the same matches and reactor already defined at %s",
+			source, sch.Action, prev)
+	}
+	l.actions[key] = source
+	sch.source = source
+	l.schema.Actions = append(l.schema.Actions, sch)
+	return nil
+}
+
+func (l *schemaLoader) addWritable(source string, node *yaml.Node) error {
+	sch := &WritableSchema{}
+	if err := decodeNode(node, sch); err != nil {
+		return fmt.Errorf("%s: %w", source, err)
+	}
+	if err := sch.Init(); err != nil {
+		return fmt.Errorf("%s: %w", source, err)
+	}
+	key := sch.Component + "/" + sch.Endpoint
+	if prev, exist := l.writes[key]; exist {
+		return fmt.Errorf("%s: writable %s already defined at %s", source, key, prev)
+	}
+	l.writes[key] = source
+	l.schema.Writable = append(l.schema.Writable, sch)
+	return nil
+}
+
+func (l *schemaLoader) include(filename, source string, node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode || node.Value == "" {
+		return fmt.Errorf("%s: include expects a file name or pattern", source)
+	}
+	pattern := node.Value
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(filename), pattern)
+	}
+	if err := l.loadPattern(pattern); err != nil {
+		return fmt.Errorf("%s: include %s: %w", source, node.Value, err)
+	}
+	l.schema.Include = append(l.schema.Include, node.Value)
+	return nil
+}
+
+func decodeNode(node *yaml.Node, out interface{}) error {
+	var raw interface{}
+	if err := node.Decode(&raw); err != nil {
+		return err
+	}
+	return schemaMapper.Map(out, normalizeMap(raw))
+}
+
+func newObjectsTemplate(name string) *template.Template {
+	return template.New(name).Funcs(templateFuncs())
+}
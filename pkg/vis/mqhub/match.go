@@ -0,0 +1,15 @@
+package mqhub
+
+import "github.com/robotalks/see/pkg/vis"
+
+// actionEnv creates the environment for evaluating conditions on an
+// action message. Properties of the message are variables, and msg
+// is the whole message.
+func actionEnv(msg vis.Msg) *Env {
+	vars := make(map[string]interface{}, len(msg)+1)
+	for key, val := range msg {
+		vars[key] = val
+	}
+	vars["msg"] = map[string]interface{}(msg)
+	return &Env{Vars: vars, Funcs: libFuncs}
+}
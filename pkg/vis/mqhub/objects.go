@@ -0,0 +1,336 @@
+package mqhub
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/robotalks/see/pkg/vis"
+)
+
+// objectsRenderer renders objects from the Context
+type objectsRenderer interface {
+	// name identifies the renderer in errors
+	name() string
+	// render renders objects affected by changed states, or all objects
+	// if changed is nil, and returns all objects
+	render(ctx *Context, changed map[stateKey]bool) ([]vis.Object, []*renderError)
+}
+
+// stateKey identifies a state, or all states of a component
+// if endpoint is empty
+type stateKey struct {
+	id       string
+	endpoint string
+}
+
+// renderError is a failure of rendering one object, or all objects
+// of a renderer if all is set
+type renderError struct {
+	source string
+	// id is empty if unknown
+	id  string
+	all bool
+	err error
+}
+
+func (e *renderError) Error() string {
+	if e.id != "" {
+		return fmt.Sprintf("%s: object %s: %v", e.source, e.id, e.err)
+	}
+	return fmt.Sprintf("%s: %v", e.source, e.err)
+}
+
+// templateRenderer renders objects from a JSON text template
+type templateRenderer struct {
+	template *template.Template
+}
+
+func (r *templateRenderer) name() string {
+	return r.template.Name()
+}
+
+// render always renders all objects, as the dependencies of
+// a template are unknown
+func (r *templateRenderer) render(ctx *Context, changed map[stateKey]bool) ([]vis.Object, []*renderError) {
+	objs, err := ctx.Render(r.template)
+	if err != nil {
+		return nil, []*renderError{{source: r.name(), all: true, err: err}}
+	}
+	return objs, nil
+}
+
+// objectDef is a structured object definition, string values
+// containing ${expression} are evaluated against the Context
+type objectDef struct {
+	source string
+	// id is known if it's not an expression
+	id   string
+	node exprNode
+
+	// result of the last rendering and states it depends on
+	rendered bool
+	obj      vis.Object
+	err      error
+	deps     map[stateKey]bool
+}
+
+// defsRenderer renders structured object definitions from a file
+type defsRenderer struct {
+	filename string
+	defs     []*objectDef
+}
+
+func (r *defsRenderer) name() string {
+	return r.filename
+}
+
+func (r *defsRenderer) render(ctx *Context, changed map[stateKey]bool) (objs []vis.Object, errs []*renderError) {
+	ctx.lock.RLock()
+	defer ctx.lock.RUnlock()
+	var deps map[stateKey]bool
+	env := ctx.env(func(id, endpoint string) {
+		deps[stateKey{id: id, endpoint: endpoint}] = true
+	})
+	for _, def := range r.defs {
+		if !def.rendered || def.dependsOn(changed) {
+			deps = make(map[stateKey]bool)
+			def.obj, def.err = def.render(env)
+			def.deps, def.rendered = deps, true
+		}
+		if def.err != nil {
+			errs = append(errs, &renderError{source: def.source, id: def.id, err: def.err})
+			continue
+		}
+		objs = append(objs, def.obj)
+	}
+	return
+}
+
+func (d *objectDef) dependsOn(changed map[stateKey]bool) bool {
+	if changed == nil {
+		return true
+	}
+	for key := range changed {
+		if d.deps[key] || d.deps[stateKey{id: key.id}] {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *objectDef) render(env *Env) (vis.Object, error) {
+	val, err := d.node.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("object must be a map")
+	}
+	// values from the Context are copied as they change in place
+	obj := vis.Object(copyValue(m).(map[string]interface{}))
+	if obj.ID() == "" {
+		return nil, fmt.Errorf("id must be a non-empty string")
+	}
+	return obj, nil
+}
+
+// env creates the environment for expressions, track is called with
+// states used by expressions. It must be called with lock held.
+func (c *Context) env(track func(id, endpoint string)) *Env {
+	vars := make(map[string]interface{}, len(c.Objects))
+	for id, obj := range c.Objects {
+		vars[id] = obj
+	}
+	return &Env{Vars: vars, Funcs: ctxFuncs(c, track), Track: track}
+}
+
+// copyValue deeply copies maps and lists
+func copyValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case vis.Object:
+		return copyValue(map[string]interface{}(v))
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[key] = copyValue(item)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = copyValue(item)
+		}
+		return list
+	}
+	return val
+}
+
+// compileObjectDef compiles a structured object definition
+func compileObjectDef(source string, def interface{}) (*objectDef, error) {
+	m, ok := def.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: object must be a map", source)
+	}
+	d := &objectDef{source: source}
+	switch id := m[vis.PropID].(type) {
+	case nil:
+		return nil, fmt.Errorf("%s: object requires id", source)
+	case string:
+		if !strings.Contains(id, "${") {
+			d.id = id
+		}
+	}
+	node, err := compileValue(m)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+	d.node = node
+	return d, nil
+}
+
+// compileValue compiles a value from YAML. A string which is exactly
+// one ${expression} evaluates to the value of the expression, keeping
+// its type. Expressions inside other text are formatted as strings.
+// Use $${ for a literal ${.
+func compileValue(val interface{}) (exprNode, error) {
+	switch v := val.(type) {
+	case string:
+		return compileInterpolation(v)
+	case map[string]interface{}:
+		node := &mapNode{values: make(map[string]exprNode, len(v))}
+		for key, item := range v {
+			itemNode, err := compileValue(item)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			node.keys = append(node.keys, key)
+			node.values[key] = itemNode
+		}
+		sort.Strings(node.keys)
+		return node, nil
+	case []interface{}:
+		node := &listNode{}
+		for n, item := range v {
+			itemNode, err := compileValue(item)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", n, err)
+			}
+			node.items = append(node.items, itemNode)
+		}
+		return node, nil
+	}
+	return &literalNode{val: val}, nil
+}
+
+func compileInterpolation(str string) (exprNode, error) {
+	var parts []exprNode
+	var text strings.Builder
+	for pos := 0; pos < len(str); {
+		switch {
+		case strings.HasPrefix(str[pos:], "$${"):
+			text.WriteString("${")
+			pos += 3
+		case strings.HasPrefix(str[pos:], "${"):
+			end, err := exprEnd(str, pos+2)
+			if err != nil {
+				return nil, err
+			}
+			expr, err := CompileExpr(str[pos+2 : end])
+			if err != nil {
+				return nil, err
+			}
+			if text.Len() > 0 {
+				parts = append(parts, &literalNode{val: text.String()})
+				text.Reset()
+			}
+			parts = append(parts, expr.root)
+			pos = end + 1
+		default:
+			text.WriteByte(str[pos])
+			pos++
+		}
+	}
+	switch {
+	case len(parts) == 0:
+		return &literalNode{val: text.String()}, nil
+	case len(parts) == 1 && text.Len() == 0:
+		if _, isLiteral := parts[0].(*literalNode); !isLiteral {
+			return parts[0], nil
+		}
+	}
+	if text.Len() > 0 {
+		parts = append(parts, &literalNode{val: text.String()})
+	}
+	return &interpolationNode{parts: parts}, nil
+}
+
+// exprEnd finds the closing brace of ${...}, skipping quoted strings
+func exprEnd(str string, pos int) (int, error) {
+	for pos < len(str) {
+		switch str[pos] {
+		case '}':
+			return pos, nil
+		case '"', '\'':
+			_, end, err := scanString(str, pos)
+			if err != nil {
+				return 0, err
+			}
+			pos = end
+		default:
+			pos++
+		}
+	}
+	return 0, fmt.Errorf("%s: missing } in ${", str)
+}
+
+type mapNode struct {
+	keys   []string
+	values map[string]exprNode
+}
+
+func (n *mapNode) eval(env *Env) (interface{}, error) {
+	m := make(map[string]interface{}, len(n.keys))
+	for _, key := range n.keys {
+		val, err := n.values[key].eval(env)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		m[key] = val
+	}
+	return m, nil
+}
+
+type listNode struct {
+	items []exprNode
+}
+
+func (n *listNode) eval(env *Env) (interface{}, error) {
+	list := make([]interface{}, 0, len(n.items))
+	for i, item := range n.items {
+		val, err := item.eval(env)
+		if err != nil {
+			return nil, fmt.Errorf("[%d]: %w", i, err)
+		}
+		list = append(list, val)
+	}
+	return list, nil
+}
+
+type interpolationNode struct {
+	parts []exprNode
+}
+
+func (n *interpolationNode) eval(env *Env) (interface{}, error) {
+	var sb strings.Builder
+	for _, part := range n.parts {
+		val, err := part.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		sb.WriteString(toString(val))
+	}
+	return sb.String(), nil
+}
@@ -6,13 +6,13 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"text/template"
 
-	"github.com/easeway/langx.go/mapper"
 	"github.com/robotalks/see/pkg/vis"
-	yaml "gopkg.in/yaml.v3"
 )
 
 // StateSchema defines a cached state
@@ -21,6 +21,8 @@ type StateSchema struct {
 	Endpoint    string `json:"endpoint"`
 	APIPath     string `json:"api-path"`
 	ContentType string `json:"content-type"`
+	// History is the number of recent values kept, DefaultHistorySize if 0
+	History int `json:"history"`
 }
 
 // MuteSchema defines states without notifying object change
@@ -33,11 +35,14 @@ type MuteSchema struct {
 type ActionSchema struct {
 	Action    string          `json:"action"`
 	Matches   []ActionMatcher `json:"matches"`
+	When      string          `json:"when"`
 	Component string          `json:"component"`
 	Endpoint  string          `json:"endpoint"`
 	Template  string          `json:"data"`
 
 	template *template.Template
+	when     *Expr
+	source   string
 }
 
 // ActionMatcher matches an action
@@ -48,22 +53,35 @@ type ActionMatcher struct {
 
 // Init initializes internal states of ActionSchema
 func (s *ActionSchema) Init() error {
-	t, err := template.New("data").Funcs(template.FuncMap{
-		"scalef": func(val, factor float64) float64 {
-			return val * factor
-		},
-		"scalei": func(val, factor float64) int64 {
-			return int64(val * factor)
-		},
-	}).Parse(s.Template)
+	t, err := template.New("data").Funcs(templateFuncs()).Parse(s.Template)
 	if err != nil {
 		return err
 	}
 	s.template = t.Templates()[0]
+	if s.When != "" {
+		if s.when, err = CompileExpr(s.When); err != nil {
+			return fmt.Errorf("when: %w", err)
+		}
+	}
 	return nil
 }
 
-// MatchAction determine if this schema matches the action
+// matchKey identifies the action, matches and reactor for detecting conflicts
+func (s *ActionSchema) matchKey() string {
+	matches := make([]string, 0, len(s.Matches)+1)
+	for _, m := range s.Matches {
+		matches = append(matches, strings.Join(m.Keys, ".")+"="+m.Value)
+	}
+	if s.When != "" {
+		matches = append(matches, "when="+s.When)
+	}
+	sort.Strings(matches)
+	return s.Action + "?" + strings.Join(matches, "&") + ">" + s.Component + "/" + s.Endpoint
+}
+
+// MatchAction determine if this schema matches the action. All matches
+// and the when condition must be satisfied, a condition failing to
+// evaluate doesn't match.
 func (s *ActionSchema) MatchAction(msg vis.Msg) bool {
 	if s.Action != msg.Action() {
 		return false
@@ -77,25 +95,34 @@ func (s *ActionSchema) MatchAction(msg vis.Msg) bool {
 			return false
 		}
 	}
+	if s.when != nil {
+		val, err := s.when.Eval(actionEnv(msg))
+		return err == nil && truthy(val)
+	}
 	return true
 }
 
 // Render renders the data template
 func (s *ActionSchema) Render(ctx *Context, msg vis.Msg) ([]byte, error) {
 	var buf bytes.Buffer
+	ctx.lock.RLock()
 	err := s.template.Execute(&buf, map[string]interface{}{
 		"action": msg,
 		"ctx":    ctx,
 	})
+	ctx.lock.RUnlock()
 	return buf.Bytes(), err
 }
 
 // TopSchema is the top-level schema
 type TopSchema struct {
-	Template string          `json:"objects"`
-	States   []*StateSchema  `json:"states"`
-	Muted    []*MuteSchema   `json:"mute"`
-	Actions  []*ActionSchema `json:"actions"`
+	Include  []string          `json:"include"`
+	Template string            `json:"objects"`
+	States   []*StateSchema    `json:"states"`
+	Muted    []*MuteSchema     `json:"mute"`
+	Actions  []*ActionSchema   `json:"actions"`
+	Refresh  RefreshSchema     `json:"refresh"`
+	Writable []*WritableSchema `json:"writable"`
 }
 
 // IsMuted indicates and object/endpoint is muted
@@ -113,19 +140,29 @@ type Context struct {
 	Objects map[string]vis.Object
 	States  map[string]map[string][]byte
 
-	lock sync.RWMutex
+	seq         uint64
+	records     map[stateKey][]*stateRecord
+	subscribers map[stateKey]map[chan *stateRecord]bool
+	lock        sync.RWMutex
 }
 
 // NewSchemaCtx creates a Context
 func NewSchemaCtx() *Context {
 	return &Context{
-		Objects: make(map[string]vis.Object),
-		States:  make(map[string]map[string][]byte),
+		Objects:     make(map[string]vis.Object),
+		States:      make(map[string]map[string][]byte),
+		records:     make(map[stateKey][]*stateRecord),
+		subscribers: make(map[stateKey]map[chan *stateRecord]bool),
 	}
 }
 
 // UpdateProperty updates a single property of an object
 func (c *Context) UpdateProperty(id, property string, value []byte) {
+	c.updateProperty(id, property, value, DefaultHistorySize)
+}
+
+// updateProperty updates a property and keeps history values of it
+func (c *Context) updateProperty(id, property string, value []byte, history int) {
 	var parsed interface{}
 	if json.Unmarshal(value, &parsed) != nil {
 		parsed = nil
@@ -151,6 +188,7 @@ func (c *Context) UpdateProperty(id, property string, value []byte) {
 		c.States[id] = s
 	}
 	s[property] = value
+	c.record(stateKey{id: id, endpoint: property}, value, history)
 }
 
 // FindState gets the raw state of specified object/property
@@ -199,63 +237,134 @@ func normalizeMap(val interface{}) interface{} {
 	return val
 }
 
+// RenderErrorSource is the source of error messages about rendering objects
+const RenderErrorSource = "mqhub/objects"
+
 // Schema is a loaded schema
 type Schema struct {
-	schema   TopSchema
-	template *template.Template
-	context  *Context
-	current  []vis.Object
+	schema    TopSchema
+	renderers []objectsRenderer
+	patterns  []string
+	files     []string
+	dirs      []string
+	context   *Context
+	current   []vis.Object
+	// origins maps rendered object ids to renderer names
+	origins map[string]string
+	// renderErr is the last reported render error
+	renderErr string
 }
 
 // LoadSchemaFile load schema from file
 func LoadSchemaFile(filename string) (*Schema, error) {
-	content, err := os.ReadFile(filename)
-	if err != nil {
-		return nil, err
+	return LoadSchemaFiles(filename)
+}
+
+// LoadSchemaFiles loads schema from files or glob patterns, including
+// files listed in include. States, mute and actions are merged and
+// objects are rendered in the order of loading.
+func LoadSchemaFiles(patterns ...string) (*Schema, error) {
+	l := newSchemaLoader()
+	for _, pattern := range patterns {
+		if err := l.loadPattern(pattern); err != nil {
+			return nil, err
+		}
 	}
-	var out map[string]interface{}
-	if err = yaml.Unmarshal(content, &out); err != nil {
-		return nil, err
+	if len(l.files) == 0 {
+		return nil, fmt.Errorf("no schema files match %s", strings.Join(patterns, ", "))
 	}
-	out = normalizeMap(out).(map[string]interface{})
+	return &Schema{
+		schema:    l.schema,
+		renderers: l.renderers,
+		patterns:  patterns,
+		files:     l.files,
+		dirs:      l.dirs,
+		context:   NewSchemaCtx(),
+	}, nil
+}
 
-	s := &Schema{context: NewSchemaCtx()}
-	if err = mapper.Map(&s.schema, out); err != nil {
-		return nil, err
-	}
+// Files returns all loaded schema files
+func (s *Schema) Files() []string {
+	return s.files
+}
 
-	t, err := template.New("schema").Funcs(template.FuncMap{
-		"object": func(ctx *Context, id string) vis.Object {
-			return ctx.Objects[id]
-		},
-	}).Parse(s.schema.Template)
+// Reload loads the schema files again into a new Schema which keeps
+// the Context and rendered objects of this one
+func (s *Schema) Reload() (*Schema, error) {
+	loaded, err := LoadSchemaFiles(s.patterns...)
 	if err != nil {
 		return nil, err
 	}
-	s.template = t.Templates()[0]
+	loaded.context = s.context
+	loaded.current = s.current
+	loaded.origins = s.origins
+	loaded.renderErr = s.renderErr
+	return loaded, nil
+}
 
-	for _, a := range s.schema.Actions {
-		if err = a.Init(); err != nil {
-			return nil, err
+// render renders objects from all renderers. A failed object keeps
+// its current version, and so do all current objects from a template
+// failing as a whole, so an error doesn't blank the world.
+func (s *Schema) render(changed map[stateKey]bool) ([]vis.Object, map[string]string, []error) {
+	var objs []vis.Object
+	var errs []error
+	origins := make(map[string]string)
+	add := func(obj vis.Object, origin string) {
+		if prev, exist := origins[obj.ID()]; exist {
+			errs = append(errs, fmt.Errorf("%s: object %s already rendered by %s",
+				origin, obj.ID(), prev))
+			return
+		}
+		origins[obj.ID()] = origin
+		objs = append(objs, obj)
+	}
+	for _, r := range s.renderers {
+		result, renderErrs := r.render(s.context, changed)
+		for _, obj := range result {
+			add(obj, r.name())
+		}
+		for _, err := range renderErrs {
+			errs = append(errs, err)
+			for _, obj := range s.current {
+				if (err.id != "" && err.id == obj.ID()) || (err.all && s.origins[obj.ID()] == r.name()) {
+					add(obj, r.name())
+				}
+			}
 		}
 	}
-	return s, nil
+	return objs, origins, errs
 }
 
-// Refresh applies the context and generates messages
-func (s *Schema) Refresh() (msgs []vis.Msg) {
-	objs, err := s.context.Render(s.template)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "render template failed: %v", err)
-		return
+// Refresh applies the context and generates messages for all objects
+func (s *Schema) Refresh() []vis.Msg {
+	return s.refresh(nil, true)
+}
+
+// refresh renders objects affected by changed states, or all objects if
+// changed is nil, and generates messages for objects changed, or all
+// objects if force is set
+func (s *Schema) refresh(changed map[stateKey]bool, force bool) (msgs []vis.Msg) {
+	objs, origins, errs := s.render(changed)
+	prevObjs := make(map[string]vis.Object, len(s.current))
+	for _, obj := range s.current {
+		prevObjs[obj.ID()] = obj
 	}
 	activeObjs := make(map[string]bool)
 	for _, obj := range objs {
+		activeObjs[obj.ID()] = true
+		if prev, exist := prevObjs[obj.ID()]; exist && !force && sameObject(prev, obj) {
+			continue
+		}
+		// the server adds default properties to objects in messages,
+		// keep the rendered ones for comparing
+		sent := make(vis.Object, len(obj))
+		for key, val := range obj {
+			sent[key] = val
+		}
 		msg := make(vis.Msg)
 		msg[vis.PropAction] = vis.ActionObject
-		msg[vis.PropObject] = obj
+		msg[vis.PropObject] = sent
 		msgs = append(msgs, msg)
-		activeObjs[obj.ID()] = true
 	}
 
 	if curr := s.current; curr != nil {
@@ -269,18 +378,61 @@ func (s *Schema) Refresh() (msgs []vis.Msg) {
 		}
 	}
 	s.current = objs
+	s.origins = origins
+
+	// report errors only when changed, as Refresh runs on every update
+	lines := make([]string, 0, len(errs))
+	for _, err := range errs {
+		lines = append(lines, err.Error())
+	}
+	if errText := strings.Join(lines, "\n"); errText != s.renderErr {
+		s.renderErr = errText
+		if errText != "" {
+			fmt.Fprintf(os.Stderr, "render objects failed: %s\n", errText)
+		}
+		msgs = append(msgs, vis.ErrorMsg(RenderErrorSource, errText))
+	}
 	return
 }
 
-// UpdateObject updates one property of the object and gets update messages
+// UpdateObject updates one property of the object and gets update
+// messages of objects changed
 func (s *Schema) UpdateObject(id, property string, value []byte) []vis.Msg {
-	s.context.UpdateProperty(id, property, value)
-	if !s.schema.IsMuted(id, property) {
-		return s.Refresh()
+	if s.updateState(id, property, value) {
+		return s.refresh(map[stateKey]bool{{id: id, endpoint: property}: true}, false)
 	}
 	return nil
 }
 
+// updateState updates one property without refreshing, and returns
+// whether objects should be refreshed
+func (s *Schema) updateState(id, property string, value []byte) bool {
+	history := DefaultHistorySize
+	if sch := s.findStateSchema(id, property); sch != nil && sch.History > 0 {
+		history = sch.History
+	}
+	s.context.updateProperty(id, property, value, history)
+	return !s.schema.IsMuted(id, property)
+}
+
+// findStateSchema looks up the state schema by component and endpoint
+func (s *Schema) findStateSchema(id, endpoint string) *StateSchema {
+	for _, sch := range s.schema.States {
+		if sch.Component == id && sch.Endpoint == endpoint {
+			return sch
+		}
+	}
+	return nil
+}
+
+// sameObject compares objects, which are often the same cached instance
+func sameObject(a, b vis.Object) bool {
+	if reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer() {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
 // FindStateSchema looks up the state schema by query path
 func (s *Schema) FindStateSchema(requestPath string) *StateSchema {
 	id, endpoint := path.Split(requestPath)
@@ -299,12 +451,22 @@ func (s *Schema) FindState(id, property string) ([]byte, bool) {
 	return s.context.FindState(id, property)
 }
 
-// FindAction matches the message to action schema
+// FindAction matches the message to action schema, the first one
+// if several match, see FindActions
 func (s *Schema) FindAction(msg vis.Msg) *ActionSchema {
+	if actions := s.FindActions(msg); len(actions) > 0 {
+		return actions[0]
+	}
+	return nil
+}
+
+// FindActions matches the message to action schemas, all matched
+// actions fire in the order of definition
+func (s *Schema) FindActions(msg vis.Msg) (actions []*ActionSchema) {
 	for _, sch := range s.schema.Actions {
 		if sch.MatchAction(msg) {
-			return sch
+			actions = append(actions, sch)
 		}
 	}
-	return nil
+	return
 }
@@ -0,0 +1,129 @@
+package mqhub
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/robotalks/see/pkg/vis"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// SchemaTest applies fixture states and events to a schema, and records
+// messages to browsers and messages sent to the hub for comparing with
+// the golden output:
+//
+//	schema: mqhub.yml       # relative to the test file
+//	golden: mqhub.golden    # default is the test file with extension .golden
+//	steps:                  # same as steps of SimScript, without timing
+//	  - component: btn0
+//	    endpoint: state
+//	    value: "on"
+//	  - event: {action: stick, stick: {id: motorL, pos: {y: 0.5}}}
+type SchemaTest struct {
+	Schema string     `json:"schema"`
+	Golden string     `json:"golden"`
+	Steps  []*SimStep `json:"steps"`
+
+	filename string
+}
+
+// LoadSchemaTest loads a test from a YAML or JSON file
+func LoadSchemaTest(filename string) (*SchemaTest, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var raw interface{}
+	if err = yaml.Unmarshal(content, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	t := &SchemaTest{filename: filename}
+	if err = schemaMapper.Map(t, normalizeMap(raw)); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	if t.Schema == "" {
+		return nil, fmt.Errorf("%s: schema is required", filename)
+	}
+	dir := filepath.Dir(filename)
+	for n, step := range t.Steps {
+		if _, err = step.init(dir, 0); err != nil {
+			return nil, fmt.Errorf("%s: step %d: %w", filename, n+1, err)
+		}
+	}
+	return t, nil
+}
+
+// GoldenFile is the file of the expected output
+func (t *SchemaTest) GoldenFile() string {
+	if t.Golden != "" {
+		return t.relPath(t.Golden)
+	}
+	return strings.TrimSuffix(t.filename, filepath.Ext(t.filename)) + ".golden"
+}
+
+func (t *SchemaTest) relPath(fn string) string {
+	if filepath.IsAbs(fn) {
+		return fn
+	}
+	return filepath.Join(filepath.Dir(t.filename), fn)
+}
+
+// Run loads the schema and applies the steps. The output starts with
+// the messages of the initial refresh, followed by a section per step.
+func (t *SchemaTest) Run() ([]byte, error) {
+	conn := NewSimConnector()
+	src, err := NewMsgSourceWithConnector(conn, t.relPath(t.Schema))
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	writeMsgs := func(msgs []vis.Msg) error {
+		for _, msg := range msgs {
+			encoded, err := json.Marshal(msg)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(&out, "%s %s\n", msg.Action(), encoded)
+		}
+		return nil
+	}
+	out.WriteString("# refresh\n")
+	if err = writeMsgs(src.Schema.Refresh()); err != nil {
+		return nil, err
+	}
+	for n, step := range t.Steps {
+		if step.event != nil {
+			encoded, err := json.Marshal(step.event)
+			if err != nil {
+				return nil, fmt.Errorf("step %d: %w", n+1, err)
+			}
+			fmt.Fprintf(&out, "# step %d: event %s\n", n+1, encoded)
+			conn.Reset()
+			src.RecvMessages([]vis.Msg{step.event})
+			for _, msg := range conn.Sent() {
+				fmt.Fprintf(&out, "send %s/%s %s\n", msg.Component, msg.Endpoint, printablePayload(msg.Payload))
+			}
+			continue
+		}
+		fmt.Fprintf(&out, "# step %d: state %s/%s %s\n", n+1,
+			step.Component, step.Endpoint, printablePayload(step.payload))
+		if err = writeMsgs(src.Schema.UpdateObject(step.Component, step.Endpoint, step.payload)); err != nil {
+			return nil, fmt.Errorf("step %d: %w", n+1, err)
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// printablePayload keeps text payloads on one line, and only shows the
+// size of binary ones
+func printablePayload(payload []byte) string {
+	if !utf8.Valid(payload) {
+		return fmt.Sprintf("(%d bytes)", len(payload))
+	}
+	return strings.ReplaceAll(string(payload), "\n", `\n`)
+}
@@ -0,0 +1,306 @@
+package mqhub
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	hub "github.com/robotalks/mqhub.go/mqhub"
+	"github.com/robotalks/see/pkg/vis"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// SimMessage is a message sent to the simulated hub
+type SimMessage struct {
+	Component string
+	Endpoint  string
+	Payload   []byte
+}
+
+// SimConnector is a hub.Connector without a broker, for developing and
+// testing schemas. States are fed by Update, and messages sent to
+// endpoints, like rendered actions, are recorded.
+type SimConnector struct {
+	// OnSend is optionally called with each message sent to the hub
+	OnSend func(SimMessage)
+
+	sinks map[*simWatcher]hub.MessageSink
+	sent  []SimMessage
+	lock  sync.Mutex
+}
+
+// NewSimConnector creates a SimConnector
+func NewSimConnector() *SimConnector {
+	return &SimConnector{sinks: make(map[*simWatcher]hub.MessageSink)}
+}
+
+// Update feeds a state to watchers as if published by a component
+func (c *SimConnector) Update(component, endpoint string, payload []byte) {
+	msg := &simMessage{component: component, endpoint: endpoint, payload: payload}
+	c.lock.Lock()
+	sinks := make([]hub.MessageSink, 0, len(c.sinks))
+	for _, sink := range c.sinks {
+		sinks = append(sinks, sink)
+	}
+	c.lock.Unlock()
+	for _, sink := range sinks {
+		sink.ConsumeMessage(msg)
+	}
+}
+
+// Sent returns messages sent to the hub so far
+func (c *SimConnector) Sent() []SimMessage {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]SimMessage(nil), c.sent...)
+}
+
+// Reset clears recorded messages
+func (c *SimConnector) Reset() {
+	c.lock.Lock()
+	c.sent = nil
+	c.lock.Unlock()
+}
+
+func (c *SimConnector) send(component, endpoint string, msg hub.Message) hub.Future {
+	var payload []byte
+	if encoded, ok := msg.(hub.EncodedPayload); ok {
+		payload, _ = encoded.Payload()
+	} else if val, ok := msg.Value(); ok {
+		payload, _ = json.Marshal(val)
+	}
+	sent := SimMessage{Component: component, Endpoint: endpoint, Payload: payload}
+	c.lock.Lock()
+	c.sent = append(c.sent, sent)
+	onSend := c.OnSend
+	c.lock.Unlock()
+	if onSend != nil {
+		onSend(sent)
+	}
+	return &hub.ImmediateFuture{}
+}
+
+// Close implements hub.Connector
+func (c *SimConnector) Close() error {
+	return nil
+}
+
+// Connect implements hub.Connector
+func (c *SimConnector) Connect() hub.Future {
+	return &hub.ImmediateFuture{}
+}
+
+// Watch implements hub.Connector
+func (c *SimConnector) Watch(sink hub.MessageSink) (hub.Watcher, error) {
+	w := &simWatcher{conn: c}
+	c.lock.Lock()
+	c.sinks[w] = sink
+	c.lock.Unlock()
+	return w, nil
+}
+
+// Publish implements hub.Connector, components are not simulated
+func (c *SimConnector) Publish(hub.Component) (hub.Publication, error) {
+	return nil, fmt.Errorf("publish is not supported by simulated hub")
+}
+
+// Describe implements hub.Connector
+func (c *SimConnector) Describe(componentID string) hub.Descriptor {
+	return &simDescriptor{conn: c, id: componentID}
+}
+
+type simWatcher struct {
+	conn *SimConnector
+}
+
+func (w *simWatcher) Close() error {
+	w.conn.lock.Lock()
+	delete(w.conn.sinks, w)
+	w.conn.lock.Unlock()
+	return nil
+}
+
+func (w *simWatcher) Watched() hub.Watchable {
+	return w.conn
+}
+
+type simDescriptor struct {
+	conn *SimConnector
+	id   string
+}
+
+func (d *simDescriptor) Watch(sink hub.MessageSink) (hub.Watcher, error) {
+	return nil, fmt.Errorf("watching a component is not supported by simulated hub")
+}
+
+func (d *simDescriptor) ID() string {
+	return d.id
+}
+
+func (d *simDescriptor) SubComponent(id ...string) hub.Descriptor {
+	return &simDescriptor{conn: d.conn, id: path.Join(append([]string{d.id}, id...)...)}
+}
+
+func (d *simDescriptor) Endpoint(name string) hub.EndpointRef {
+	return &simEndpoint{conn: d.conn, component: d.id, name: name}
+}
+
+type simEndpoint struct {
+	conn      *SimConnector
+	component string
+	name      string
+}
+
+func (e *simEndpoint) Watch(sink hub.MessageSink) (hub.Watcher, error) {
+	return nil, fmt.Errorf("watching an endpoint is not supported by simulated hub")
+}
+
+func (e *simEndpoint) ConsumeMessage(msg hub.Message) hub.Future {
+	return e.conn.send(e.component, e.name, msg)
+}
+
+// simMessage is a state from a simulated component
+type simMessage struct {
+	component string
+	endpoint  string
+	payload   []byte
+}
+
+func (m *simMessage) Component() string          { return m.component }
+func (m *simMessage) Endpoint() string           { return m.endpoint }
+func (m *simMessage) Value() (interface{}, bool) { return m.payload, true }
+func (m *simMessage) IsState() bool              { return true }
+func (m *simMessage) As(out interface{}) error   { return json.Unmarshal(m.payload, out) }
+func (m *simMessage) Payload() ([]byte, error)   { return m.payload, nil }
+
+// SimScript is a timed script of states and browser events:
+//
+//	loop: true
+//	steps:
+//	  - component: btn0
+//	    endpoint: state
+//	    value: "on"           # encoded as JSON
+//	  - after: 500ms
+//	    component: cam0
+//	    endpoint: still
+//	    file: frame.jpg       # raw content, relative to the script
+//	  - at: 2s
+//	    event: {action: stick, stick: {id: motorL, pos: {y: 0.5}}}
+type SimScript struct {
+	Loop  bool       `json:"loop"`
+	Steps []*SimStep `json:"steps"`
+}
+
+// SimStep is a step of SimScript, at is the time since the start of the
+// script, or after is the time since the previous step
+type SimStep struct {
+	At        string      `json:"at"`
+	After     string      `json:"after"`
+	Component string      `json:"component"`
+	Endpoint  string      `json:"endpoint"`
+	Value     interface{} `json:"value"`
+	Raw       string      `json:"raw"`
+	File      string      `json:"file"`
+	Event     interface{} `json:"event"`
+
+	offset  time.Duration
+	payload []byte
+	event   vis.Msg
+}
+
+// LoadSimScript loads a script from a YAML or JSON file
+func LoadSimScript(filename string) (*SimScript, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var raw interface{}
+	if err = yaml.Unmarshal(content, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	script := &SimScript{}
+	if err = schemaMapper.Map(script, normalizeMap(raw)); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	var offset time.Duration
+	for n, step := range script.Steps {
+		if offset, err = step.init(filepath.Dir(filename), offset); err != nil {
+			return nil, fmt.Errorf("%s: step %d: %w", filename, n+1, err)
+		}
+	}
+	if script.Loop && offset == 0 {
+		return nil, fmt.Errorf("%s: loop requires steps with at or after", filename)
+	}
+	return script, nil
+}
+
+func (s *SimStep) init(dir string, offset time.Duration) (time.Duration, error) {
+	var err error
+	switch {
+	case s.At != "":
+		offset, err = time.ParseDuration(s.At)
+	case s.After != "":
+		var after time.Duration
+		after, err = time.ParseDuration(s.After)
+		offset += after
+	}
+	if err != nil {
+		return 0, err
+	}
+	s.offset = offset
+	if s.Event != nil {
+		event, ok := s.Event.(map[string]interface{})
+		if !ok {
+			return 0, fmt.Errorf("event must be a map")
+		}
+		s.event = vis.Msg(event)
+		return offset, nil
+	}
+	if s.Component == "" || s.Endpoint == "" {
+		return 0, fmt.Errorf("component and endpoint are required")
+	}
+	switch {
+	case s.File != "":
+		fn := s.File
+		if !filepath.IsAbs(fn) {
+			fn = filepath.Join(dir, fn)
+		}
+		s.payload, err = os.ReadFile(fn)
+	case s.Raw != "":
+		s.payload = []byte(s.Raw)
+	default:
+		s.payload, err = json.Marshal(s.Value)
+	}
+	return offset, err
+}
+
+// Play runs the script in real time, feeding states to the connector and
+// events to the sink, like MsgSource receiving browser events. It
+// returns when the script ends, or done is closed.
+func (s *SimScript) Play(conn *SimConnector, events vis.MessageSink, done <-chan struct{}) {
+	for {
+		start := time.Now()
+		for _, step := range s.Steps {
+			if wait := time.Until(start.Add(step.offset)); wait > 0 {
+				select {
+				case <-done:
+					return
+				case <-time.After(wait):
+				}
+			}
+			if step.event != nil {
+				events.RecvMessages([]vis.Msg{step.event})
+			} else {
+				conn.Update(step.Component, step.Endpoint, step.payload)
+			}
+		}
+		// a script without timing is played once even if looping
+		if !s.Loop || len(s.Steps) == 0 || s.Steps[len(s.Steps)-1].offset == 0 {
+			return
+		}
+	}
+}
@@ -4,8 +4,13 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	hub "github.com/robotalks/mqhub.go/mqhub"
 	// load mqtt impl
 	_ "github.com/robotalks/mqhub.go/mqtt"
@@ -16,60 +21,146 @@ import (
 type MsgSource struct {
 	Connector hub.Connector
 	Schema    *Schema
+	ServerURL string
+	// WriteToken is required for writing endpoints if not empty
+	WriteToken string
 
-	msgCh chan hub.Message
+	msgCh     chan hub.Message
+	reloadCh  chan struct{}
+	watcher   *fsnotify.Watcher
+	connected int32
+	lock      sync.RWMutex
 }
 
-// NewMsgSource creates MsgSource
-func NewMsgSource(mqttURL, schemaFile string) (s *MsgSource, err error) {
-	s = &MsgSource{msgCh: make(chan hub.Message)}
-	if s.Connector, err = hub.NewConnector(mqttURL); err != nil {
-		return
+// NewMsgSource creates MsgSource, see LoadSchemaFiles for schemaFiles
+func NewMsgSource(mqttURL string, schemaFiles ...string) (*MsgSource, error) {
+	conn, err := hub.NewConnector(mqttURL)
+	if err != nil {
+		return nil, err
 	}
-	if s.Schema, err = LoadSchemaFile(schemaFile); err != nil {
-		return
+	s, err := NewMsgSourceWithConnector(conn, schemaFiles...)
+	if err != nil {
+		return nil, err
+	}
+	s.ServerURL = mqttURL
+	return s, nil
+}
+
+// NewMsgSourceWithConnector creates MsgSource on a connector, like SimConnector
+func NewMsgSourceWithConnector(conn hub.Connector, schemaFiles ...string) (s *MsgSource, err error) {
+	s = &MsgSource{
+		Connector: conn,
+		msgCh:     make(chan hub.Message),
+		reloadCh:  make(chan struct{}),
+	}
+	if s.Schema, err = LoadSchemaFiles(schemaFiles...); err != nil {
+		return nil, err
 	}
 	return
 }
 
+func (s *MsgSource) schema() *Schema {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.Schema
+}
+
+func (s *MsgSource) setSchema(sch *Schema) {
+	s.lock.Lock()
+	s.Schema = sch
+	s.lock.Unlock()
+}
+
 // Connect connects to MQTT
 func (s *MsgSource) Connect() error {
 	if err := s.Connector.Connect().Wait(); err != nil {
 		return err
 	}
 	_, err := s.Connector.Watch(hub.MessageSinkFunc(s.handleMsg))
+	if err == nil {
+		atomic.StoreInt32(&s.connected, 1)
+	}
 	return err
 }
 
+// SourceStatus implements vis.StatusReporter
+func (s *MsgSource) SourceStatus() vis.SourceStatus {
+	status := vis.SourceStatus{
+		Kind:      "mqhub",
+		Address:   s.ServerURL,
+		Connected: atomic.LoadInt32(&s.connected) != 0,
+	}
+	if u, err := url.Parse(s.ServerURL); err == nil {
+		status.Address = u.Redacted()
+	}
+	return status
+}
+
 // RecvMessages implements vis.MessageSink
 func (s *MsgSource) RecvMessages(msgs []vis.Msg) {
+	schema := s.schema()
 	for _, msg := range msgs {
 		action := msg.Action()
 		if action == "" {
 			continue
 		}
-		sch := s.Schema.FindAction(msg)
-		if sch == nil {
+		if action == ActionSet {
+			s.handleSet(msg)
 			continue
 		}
-		data, err := sch.Render(s.Schema.context, msg)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "render data for reactor %s/%s error: %v\n",
-				sch.Component, sch.Endpoint, err)
-			continue
+		for _, sch := range schema.FindActions(msg) {
+			data, err := sch.Render(schema.context, msg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "render data for reactor %s/%s error: %v\n",
+					sch.Component, sch.Endpoint, err)
+				continue
+			}
+			s.Connector.
+				Describe(sch.Component).
+				Endpoint(sch.Endpoint).
+				ConsumeMessage(hub.StreamMessage(data))
 		}
-		s.Connector.
-			Describe(sch.Component).
-			Endpoint(sch.Endpoint).
-			ConsumeMessage(hub.StreamMessage(data))
 	}
 }
 
 // ProcessMessages implements vis.MsgSource
 func (s *MsgSource) ProcessMessages(sink vis.MessageSink) error {
-	sink.RecvMessages(s.Schema.Refresh())
+	sink.RecvMessages(s.schema().Refresh())
+	sched := newRefreshScheduler(&s.schema().schema.Refresh)
+	var timer *time.Timer
+	var timerCh <-chan time.Time
+	// next is the deadline of the timer, zero if not scheduled
+	var next time.Time
+	schedule := func(at time.Time) {
+		if timer != nil {
+			timer.Stop()
+		}
+		timer, timerCh, next = nil, nil, at
+		if !at.IsZero() {
+			timer = time.NewTimer(time.Until(at))
+			timerCh = timer.C
+		}
+	}
+	defer schedule(time.Time{})
 	for {
-		msg, ok := <-s.msgCh
+		var msg hub.Message
+		var ok bool
+		select {
+		case <-s.reloadCh:
+			if s.reload(sink) {
+				// the full refresh covers pending changes
+				sched = newRefreshScheduler(&s.schema().schema.Refresh)
+				schedule(time.Time{})
+			} else {
+				// the old schema stays, keep refreshing pending changes
+				schedule(s.refreshDue(sched, sink))
+			}
+			continue
+		case <-timerCh:
+			schedule(s.refreshDue(sched, sink))
+			continue
+		case msg, ok = <-s.msgCh:
+		}
 		if !ok {
 			return io.EOF
 		}
@@ -81,13 +172,36 @@ func (s *MsgSource) ProcessMessages(sink vis.MessageSink) error {
 		}
 		payload, err := encoded.Payload()
 		if err != nil {
+			vis.SinkMetrics(sink).SourceDecodeError("mqhub")
 			continue
 		}
-		msgs := s.Schema.UpdateObject(component, endpoint, payload)
-		if msgs != nil {
+		if s.schema().updateState(component, endpoint, payload) {
+			key := stateKey{id: component, endpoint: endpoint}
+			sched.add(key)
+			// keep waiting for the timer unless this change is due earlier,
+			// so a rate limited component doesn't hold back others
+			if next.IsZero() || sched.dueTime(key).Before(next) {
+				schedule(s.refreshDue(sched, sink))
+			}
+		}
+	}
+}
+
+// refreshDue refreshes objects by changes due, and returns the time to
+// refresh changes left, zero if none
+func (s *MsgSource) refreshDue(sched *refreshScheduler, sink vis.MessageSink) time.Time {
+	now := time.Now()
+	changed, wait := sched.due(now)
+	if changed != nil {
+		if msgs := s.schema().refresh(changed, false); msgs != nil {
+			vis.SinkMetrics(sink).SourceReceived("mqhub", msgs)
 			sink.RecvMessages(msgs)
 		}
 	}
+	if wait > 0 {
+		return now.Add(wait)
+	}
+	return time.Time{}
 }
 
 // AddHandlers implements ServerExt
@@ -101,26 +215,3 @@ func (s *MsgSource) handleMsg(msg hub.Message) hub.Future {
 	s.msgCh <- msg
 	return nil
 }
-
-func (s *MsgSource) serveStates(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Write([]byte("only GET is allowed"))
-		return
-	}
-	sch := s.Schema.FindStateSchema(r.URL.Path)
-	if sch != nil {
-		if val, exist := s.Schema.FindState(sch.Component, sch.Endpoint); exist {
-			contentType := sch.ContentType
-			if contentType == "" {
-				contentType = "application/octet-stream"
-			}
-			w.Header().Add("Content-type", contentType)
-			w.Write(val)
-			return
-		}
-	}
-	w.WriteHeader(http.StatusNotFound)
-	w.Write([]byte("not found"))
-	return
-}
@@ -0,0 +1,360 @@
+package mqhub
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultHistorySize is the number of recent values kept for a state,
+// only the latest unless its states schema declares history
+const DefaultHistorySize = 1
+
+// etagPrefix makes ETags different across restarts
+var etagPrefix = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+// stateRecord is a value of a state
+type stateRecord struct {
+	seq   uint64
+	time  time.Time
+	value []byte
+}
+
+func (r *stateRecord) etag() string {
+	return fmt.Sprintf(`"%s-%d"`, etagPrefix, r.seq)
+}
+
+// StateView describes a state in the state API
+type StateView struct {
+	Component   string      `json:"component"`
+	Endpoint    string      `json:"endpoint"`
+	Path        string      `json:"path"`
+	ContentType string      `json:"content-type"`
+	Seq         uint64      `json:"seq"`
+	Time        time.Time   `json:"time"`
+	ETag        string      `json:"etag"`
+	Size        int         `json:"size"`
+	Value       interface{} `json:"value,omitempty"`
+}
+
+// record keeps a value in history and notifies subscribers,
+// it must be called with lock held
+func (c *Context) record(key stateKey, value []byte, history int) {
+	c.seq++
+	rec := &stateRecord{seq: c.seq, time: time.Now(), value: value}
+	recs := c.records[key]
+	if history < 1 {
+		history = 1
+	}
+	if len(recs) >= history {
+		recs = append(recs[:0:0], recs[len(recs)-history+1:]...)
+	}
+	c.records[key] = append(recs, rec)
+	for ch := range c.subscribers[key] {
+		// slow subscribers only get the latest value
+		select {
+		case ch <- rec:
+		default:
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- rec
+		}
+	}
+}
+
+// history returns recorded values of a state, the latest is the last
+func (c *Context) history(key stateKey) []*stateRecord {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return append([]*stateRecord(nil), c.records[key]...)
+}
+
+func (c *Context) latest(key stateKey) *stateRecord {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if recs := c.records[key]; len(recs) > 0 {
+		return recs[len(recs)-1]
+	}
+	return nil
+}
+
+// stateKeys returns all known states sorted
+func (c *Context) stateKeys() []stateKey {
+	c.lock.RLock()
+	keys := make([]stateKey, 0, len(c.records))
+	for key := range c.records {
+		keys = append(keys, key)
+	}
+	c.lock.RUnlock()
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].id != keys[j].id {
+			return keys[i].id < keys[j].id
+		}
+		return keys[i].endpoint < keys[j].endpoint
+	})
+	return keys
+}
+
+// subscribe receives new values of a state until cancelled
+func (c *Context) subscribe(key stateKey) (<-chan *stateRecord, func()) {
+	ch := make(chan *stateRecord, 1)
+	c.lock.Lock()
+	subs := c.subscribers[key]
+	if subs == nil {
+		subs = make(map[chan *stateRecord]bool)
+		c.subscribers[key] = subs
+	}
+	subs[ch] = true
+	c.lock.Unlock()
+	return ch, func() {
+		c.lock.Lock()
+		delete(c.subscribers[key], ch)
+		if len(c.subscribers[key]) == 0 {
+			delete(c.subscribers, key)
+		}
+		c.lock.Unlock()
+	}
+}
+
+// stateInfo resolves a request path to a state and its content type
+func (s *Schema) stateInfo(requestPath string) (key stateKey, apiPath, contentType string) {
+	if sch := s.FindStateSchema(requestPath); sch != nil {
+		key = stateKey{id: sch.Component, endpoint: sch.Endpoint}
+		apiPath, contentType = sch.APIPath, sch.ContentType
+	} else {
+		id, endpoint := path.Split(requestPath)
+		key = stateKey{id: strings.Trim(id, "/"), endpoint: endpoint}
+	}
+	return key, s.statePath(key, apiPath), contentType
+}
+
+func (s *Schema) statePath(key stateKey, apiPath string) string {
+	if apiPath == "" {
+		if sch := s.findStateSchema(key.id, key.endpoint); sch != nil {
+			apiPath = sch.APIPath
+		}
+	}
+	if apiPath == "" {
+		apiPath = key.id + "/" + key.endpoint
+	}
+	return apiPath
+}
+
+// stateContentType is the configured content type, or detected
+func stateContentType(contentType string, value []byte) string {
+	switch {
+	case contentType != "":
+		return contentType
+	case json.Valid(value):
+		return "application/json"
+	}
+	return "application/octet-stream"
+}
+
+func (s *Schema) stateView(key stateKey, apiPath, contentType string, rec *stateRecord, withValue bool) *StateView {
+	view := &StateView{
+		Component:   key.id,
+		Endpoint:    key.endpoint,
+		Path:        apiPath,
+		ContentType: stateContentType(contentType, rec.value),
+		Seq:         rec.seq,
+		Time:        rec.time,
+		ETag:        rec.etag(),
+		Size:        len(rec.value),
+	}
+	if withValue {
+		var parsed interface{}
+		if json.Unmarshal(rec.value, &parsed) == nil {
+			view.Value = parsed
+		}
+	}
+	return view
+}
+
+// serveStates serves the state API:
+//
+//	GET /mqhub/states/                      lists all states
+//	GET|HEAD /mqhub/states/PATH             the latest raw value, with ETag
+//	GET /mqhub/states/PATH?view=json        the latest value as JSON
+//	GET /mqhub/states/PATH?history          recent values as JSON
+//	GET /mqhub/states/PATH?seq=N            a recent raw value
+//	GET /mqhub/states/PATH?stream=mjpeg     streams raw values as multipart
+//	GET /mqhub/states/PATH?stream=sse       streams values as server-sent events
+//	PUT /mqhub/states/PATH                  writes a JSON value to a writable endpoint
+func (s *MsgSource) serveStates(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		s.serveWrite(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("only GET, HEAD and PUT are allowed"))
+		return
+	}
+	schema := s.schema()
+	if r.URL.Path == "" {
+		s.serveStateList(w, schema)
+		return
+	}
+	key, apiPath, contentType := schema.stateInfo(r.URL.Path)
+	query := r.URL.Query()
+	switch {
+	case query.Get("stream") != "":
+		s.serveStateStream(w, r, schema, key, apiPath, contentType)
+		return
+	case query.Has("history"):
+		recs := schema.context.history(key)
+		if len(recs) == 0 {
+			break
+		}
+		views := make([]*StateView, 0, len(recs))
+		for _, rec := range recs {
+			views = append(views, schema.stateView(key, apiPath, contentType, rec, true))
+		}
+		writeJSON(w, views)
+		return
+	case query.Get("seq") != "":
+		seq, err := strconv.ParseUint(query.Get("seq"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid seq", http.StatusBadRequest)
+			return
+		}
+		for _, rec := range schema.context.history(key) {
+			if rec.seq == seq {
+				serveStateValue(w, r, contentType, rec)
+				return
+			}
+		}
+	default:
+		rec := schema.context.latest(key)
+		if rec == nil {
+			break
+		}
+		if query.Get("view") == "json" || acceptsJSONView(r, stateContentType(contentType, rec.value)) {
+			w.Header().Set("Vary", "Accept")
+			w.Header().Set("ETag", fmt.Sprintf(`W/"%s-%d-json"`, etagPrefix, rec.seq))
+			if inm := r.Header.Get("If-None-Match"); inm != "" && inm == w.Header().Get("ETag") {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			writeJSON(w, schema.stateView(key, apiPath, contentType, rec, true))
+			return
+		}
+		serveStateValue(w, r, contentType, rec)
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte("not found"))
+}
+
+// serveStateValue serves a raw value, handling HEAD, ETag and
+// If-None-Match so polling doesn't download unchanged values
+func serveStateValue(w http.ResponseWriter, r *http.Request, contentType string, rec *stateRecord) {
+	w.Header().Set("Content-Type", stateContentType(contentType, rec.value))
+	w.Header().Set("ETag", rec.etag())
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "", rec.time, bytes.NewReader(rec.value))
+}
+
+// acceptsJSONView tells if the client prefers JSON to the raw content type
+func acceptsJSONView(r *http.Request, contentType string) bool {
+	if contentType == "application/json" {
+		return false
+	}
+	accept := strings.TrimSpace(strings.Split(r.Header.Get("Accept"), ",")[0])
+	return strings.HasPrefix(accept, "application/json")
+}
+
+func (s *MsgSource) serveStateList(w http.ResponseWriter, schema *Schema) {
+	views := []*StateView{}
+	for _, key := range schema.context.stateKeys() {
+		if rec := schema.context.latest(key); rec != nil {
+			var contentType string
+			if sch := schema.findStateSchema(key.id, key.endpoint); sch != nil {
+				contentType = sch.ContentType
+			}
+			views = append(views, schema.stateView(key, schema.statePath(key, ""), contentType, rec, false))
+		}
+	}
+	writeJSON(w, views)
+}
+
+func (s *MsgSource) serveStateStream(w http.ResponseWriter, r *http.Request,
+	schema *Schema, key stateKey, apiPath, contentType string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	var send func(rec *stateRecord) error
+	switch mode := r.URL.Query().Get("stream"); mode {
+	case "mjpeg":
+		mw := multipart.NewWriter(w)
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mw.Boundary())
+		send = func(rec *stateRecord) error {
+			part, err := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type":   {stateContentType(contentType, rec.value)},
+				"Content-Length": {strconv.Itoa(len(rec.value))},
+			})
+			if err == nil {
+				_, err = part.Write(rec.value)
+			}
+			return err
+		}
+	case "sse":
+		w.Header().Set("Content-Type", "text/event-stream")
+		send = func(rec *stateRecord) error {
+			encoded, err := json.Marshal(schema.stateView(key, apiPath, contentType, rec, true))
+			if err == nil {
+				_, err = fmt.Fprintf(w, "id: %d\nevent: state\ndata: %s\n\n", rec.seq, encoded)
+			}
+			return err
+		}
+	default:
+		http.Error(w, "unknown stream "+mode, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Method == http.MethodHead {
+		return
+	}
+	updates, cancel := schema.context.subscribe(key)
+	defer cancel()
+	if rec := schema.context.latest(key); rec != nil {
+		if send(rec) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case rec := <-updates:
+			if send(rec) != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, val interface{}) {
+	encoded, err := json.Marshal(val)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(encoded)
+}
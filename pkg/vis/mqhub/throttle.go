@@ -0,0 +1,139 @@
+package mqhub
+
+import (
+	"fmt"
+	"path"
+	"time"
+)
+
+// RefreshSchema limits how often objects are refreshed on state updates
+type RefreshSchema struct {
+	// Interval is the minimum interval between refreshes, like 50ms
+	Interval string `json:"interval"`
+	// Components are the minimum intervals of updates from components
+	Components []*ComponentRateSchema `json:"components"`
+
+	interval time.Duration
+}
+
+// ComponentRateSchema limits refreshes by states of matched components
+type ComponentRateSchema struct {
+	// Component is the name or a pattern like cam*
+	Component string `json:"component"`
+	Interval  string `json:"interval"`
+
+	interval time.Duration
+}
+
+// Init parses the intervals
+func (s *RefreshSchema) Init() error {
+	var err error
+	if s.interval, err = parseInterval(s.Interval); err != nil {
+		return fmt.Errorf("interval: %w", err)
+	}
+	for _, c := range s.Components {
+		if _, err = path.Match(c.Component, ""); err != nil {
+			return fmt.Errorf("component %s: %w", c.Component, err)
+		}
+		if c.interval, err = parseInterval(c.Interval); err != nil {
+			return fmt.Errorf("component %s: interval: %w", c.Component, err)
+		}
+	}
+	return nil
+}
+
+func parseInterval(str string) (time.Duration, error) {
+	if str == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(str)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("negative interval %s", str)
+	}
+	return d, err
+}
+
+// refreshScheduler coalesces state changes into refreshes. A change is
+// refreshed when both the minimum interval since the last refresh and
+// the interval of its component since the component's last refresh have
+// passed, so the final states are always refreshed.
+type refreshScheduler struct {
+	schema  *RefreshSchema
+	pending map[stateKey]bool
+	last    time.Time
+	// lastComponents are the last refresh times of rate limited components
+	lastComponents map[string]time.Time
+	// intervals caches the interval of components
+	intervals map[string]time.Duration
+}
+
+func newRefreshScheduler(sch *RefreshSchema) *refreshScheduler {
+	return &refreshScheduler{
+		schema:         sch,
+		pending:        make(map[stateKey]bool),
+		lastComponents: make(map[string]time.Time),
+		intervals:      make(map[string]time.Duration),
+	}
+}
+
+// add adds a changed state
+func (r *refreshScheduler) add(key stateKey) {
+	r.pending[key] = true
+}
+
+func (r *refreshScheduler) componentInterval(id string) time.Duration {
+	interval, ok := r.intervals[id]
+	if !ok {
+		for _, c := range r.schema.Components {
+			if matched, _ := path.Match(c.Component, id); matched {
+				interval = c.interval
+				break
+			}
+		}
+		r.intervals[id] = interval
+	}
+	return interval
+}
+
+// dueTime is the earliest time to refresh a change
+func (r *refreshScheduler) dueTime(key stateKey) time.Time {
+	due := r.last.Add(r.schema.interval)
+	if interval := r.componentInterval(key.id); interval > 0 {
+		if t := r.lastComponents[key.id].Add(interval); t.After(due) {
+			due = t
+		}
+	}
+	return due
+}
+
+// due takes changes to refresh now, and the duration to wait for the
+// next refresh if any changes are left
+func (r *refreshScheduler) due(now time.Time) (changed map[stateKey]bool, wait time.Duration) {
+	for key := range r.pending {
+		if !r.dueTime(key).After(now) {
+			if changed == nil {
+				changed = make(map[stateKey]bool)
+			}
+			changed[key] = true
+			delete(r.pending, key)
+		}
+	}
+	if changed != nil {
+		r.last = now
+		for key := range changed {
+			if r.componentInterval(key.id) > 0 {
+				r.lastComponents[key.id] = now
+			}
+		}
+	}
+	var next time.Time
+	for key := range r.pending {
+		if due := r.dueTime(key); next.IsZero() || due.Before(next) {
+			next = due
+		}
+	}
+	if !next.IsZero() {
+		wait = next.Sub(now)
+	}
+	return
+}
@@ -0,0 +1,100 @@
+package mqhub
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/robotalks/see/pkg/vis"
+)
+
+// ReloadDelay is the quiet period after a schema file change before reloading
+const ReloadDelay = 200 * time.Millisecond
+
+// Watch watches schema files and reloads the schema on change.
+// The reloaded schema keeps the states cached from the hub and refreshes
+// all objects, the old schema stays active if the new one fails to load.
+func (s *MsgSource) Watch() error {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	s.watcher = fsw
+	s.watchDirs(s.schema())
+	go s.watch()
+	return nil
+}
+
+// watchDirs watches directories instead of files, as editors often
+// replace a file by renaming
+func (s *MsgSource) watchDirs(sch *Schema) {
+	dirs := append([]string{}, sch.dirs...)
+	for _, fn := range sch.files {
+		dirs = append(dirs, filepath.Dir(fn))
+	}
+	for _, dir := range dirs {
+		if err := s.watcher.Add(dir); err != nil {
+			fmt.Fprintf(os.Stderr, "watch %s: %v\n", dir, err)
+		}
+	}
+}
+
+func (s *MsgSource) isSchemaFile(fn string) bool {
+	switch filepath.Ext(fn) {
+	case ".yml", ".yaml":
+		return true
+	}
+	absPath, err := filepath.Abs(fn)
+	if err != nil {
+		return false
+	}
+	for _, loaded := range s.schema().files {
+		if p, e := filepath.Abs(loaded); e == nil && p == absPath {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MsgSource) watch() {
+	var timer <-chan time.Time
+	for {
+		select {
+		case event, ok := <-s.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Chmod) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			if s.isSchemaFile(event.Name) {
+				timer = time.After(ReloadDelay)
+			}
+		case err, ok := <-s.watcher.Errors:
+			if !ok {
+				return
+			}
+			fmt.Fprintf(os.Stderr, "watch schema: %v\n", err)
+		case <-timer:
+			timer = nil
+			s.reloadCh <- struct{}{}
+		}
+	}
+}
+
+// reload is called from ProcessMessages to avoid racing with updates,
+// it returns false if the schema failed to load and the old one stays
+func (s *MsgSource) reload(sink vis.MessageSink) bool {
+	sch, err := s.schema().Reload()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reload schema: %v\n", err)
+		sink.RecvMessages([]vis.Msg{vis.ErrorMsg("mqhub", "schema: "+err.Error())})
+		return false
+	}
+	s.setSchema(sch)
+	s.watchDirs(sch)
+	sink.RecvMessages(append(sch.Refresh(), vis.ErrorMsg("mqhub", "")))
+	return true
+}
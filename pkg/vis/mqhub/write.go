@@ -0,0 +1,211 @@
+package mqhub
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	hub "github.com/robotalks/mqhub.go/mqhub"
+	"github.com/robotalks/see/pkg/vis"
+)
+
+// ActionSet is the action from browsers writing an endpoint:
+//
+//	{"action": "set", "component": "lamp", "endpoint": "brightness", "value": 50}
+const ActionSet = "set"
+
+// MaxWriteSize limits the body of PUT requests
+const MaxWriteSize = 1 << 20
+
+// WritableSchema declares an endpoint writable from browsers
+type WritableSchema struct {
+	Component string `json:"component"`
+	Endpoint  string `json:"endpoint"`
+	// Type is one of number, integer, boolean, string, object, array,
+	// or any by default
+	Type    string        `json:"type"`
+	Min     interface{}   `json:"min"`
+	Max     interface{}   `json:"max"`
+	Enum    []interface{} `json:"enum"`
+	Pattern string        `json:"pattern"`
+
+	min, max *float64
+	pattern  *regexp.Regexp
+}
+
+// Init validates the schema
+func (s *WritableSchema) Init() error {
+	if s.Component == "" || s.Endpoint == "" {
+		return fmt.Errorf("writable requires component and endpoint")
+	}
+	switch s.Type {
+	case "", "any", "number", "integer", "boolean", "string", "object", "array":
+	default:
+		return fmt.Errorf("unknown type %s", s.Type)
+	}
+	for _, limit := range []struct {
+		val interface{}
+		out **float64
+	}{{s.Min, &s.min}, {s.Max, &s.max}} {
+		if limit.val == nil {
+			continue
+		}
+		if !isNumber(limit.val) {
+			return fmt.Errorf("min and max must be numbers")
+		}
+		num, _ := toNumber(limit.val)
+		*limit.out = &num
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("pattern: %w", err)
+		}
+		s.pattern = re
+	}
+	return nil
+}
+
+// Validate checks a value against the declared type and limits
+func (s *WritableSchema) Validate(val interface{}) error {
+	switch s.Type {
+	case "number", "integer":
+		num, ok := val.(float64)
+		if !ok {
+			return fmt.Errorf("expect %s, got %s", s.Type, typeName(val))
+		}
+		if s.Type == "integer" && num != float64(int64(num)) {
+			return fmt.Errorf("expect integer, got %v", num)
+		}
+		if s.min != nil && num < *s.min {
+			return fmt.Errorf("%v is less than %v", num, *s.min)
+		}
+		if s.max != nil && num > *s.max {
+			return fmt.Errorf("%v is greater than %v", num, *s.max)
+		}
+	case "boolean":
+		if _, ok := val.(bool); !ok {
+			return fmt.Errorf("expect boolean, got %s", typeName(val))
+		}
+	case "string":
+		str, ok := val.(string)
+		if !ok {
+			return fmt.Errorf("expect string, got %s", typeName(val))
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			return fmt.Errorf("%q doesn't match %s", str, s.Pattern)
+		}
+	case "object":
+		if _, ok := val.(map[string]interface{}); !ok {
+			return fmt.Errorf("expect object, got %s", typeName(val))
+		}
+	case "array":
+		if _, ok := val.([]interface{}); !ok {
+			return fmt.Errorf("expect array, got %s", typeName(val))
+		}
+	}
+	if len(s.Enum) > 0 {
+		for _, item := range s.Enum {
+			if equal(val, item) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s is not one of the allowed values", toString(val))
+	}
+	return nil
+}
+
+// FindWritable looks up the writable endpoint
+func (s *Schema) FindWritable(component, endpoint string) *WritableSchema {
+	for _, sch := range s.schema.Writable {
+		if sch.Component == component && sch.Endpoint == endpoint {
+			return sch
+		}
+	}
+	return nil
+}
+
+// authorized checks the token of a write, writes are disabled without
+// WriteToken
+func (s *MsgSource) authorized(token string) bool {
+	return s.WriteToken != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(s.WriteToken)) == 1
+}
+
+// write validates and sends the value to the endpoint on the hub
+func (s *MsgSource) write(component, endpoint string, val interface{}) error {
+	sch := s.schema().FindWritable(component, endpoint)
+	if sch == nil {
+		return fmt.Errorf("%s/%s is not writable", component, endpoint)
+	}
+	if err := sch.Validate(val); err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+	s.Connector.
+		Describe(component).
+		Endpoint(endpoint).
+		ConsumeMessage(hub.StreamMessage(encoded))
+	return nil
+}
+
+// handleSet handles ActionSet from browsers
+func (s *MsgSource) handleSet(msg vis.Msg) {
+	component, _ := msg["component"].(string)
+	endpoint, _ := msg["endpoint"].(string)
+	token, _ := msg[vis.PropToken].(string)
+	if s.WriteToken == "" {
+		fmt.Fprintf(os.Stderr, "set %s/%s: writes are disabled without a token configured\n", component, endpoint)
+		return
+	}
+	if !s.authorized(token) {
+		fmt.Fprintf(os.Stderr, "set %s/%s: unauthorized\n", component, endpoint)
+		return
+	}
+	if err := s.write(component, endpoint, msg[vis.PropValue]); err != nil {
+		fmt.Fprintf(os.Stderr, "set %s/%s: %v\n", component, endpoint, err)
+	}
+}
+
+// serveWrite handles PUT /mqhub/states/<component>/<endpoint> with a
+// JSON value as the body, and the token as "Authorization: Bearer TOKEN"
+func (s *MsgSource) serveWrite(w http.ResponseWriter, r *http.Request) {
+	if s.WriteToken == "" {
+		http.Error(w, "writes are disabled without a token configured", http.StatusForbidden)
+		return
+	}
+	token := r.Header.Get("Authorization")
+	if !strings.HasPrefix(token, "Bearer ") || !s.authorized(strings.TrimPrefix(token, "Bearer ")) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	key, _, _ := s.schema().stateInfo(r.URL.Path)
+	if s.schema().FindWritable(key.id, key.endpoint) == nil {
+		http.Error(w, "not writable", http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, MaxWriteSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var val interface{}
+	if err = json.Unmarshal(body, &val); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = s.write(key.id, key.endpoint, val); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
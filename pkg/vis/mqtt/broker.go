@@ -0,0 +1,73 @@
+package mqtt
+
+import (
+	"net"
+	"os"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/rs/zerolog"
+)
+
+// Broker is an in-process MQTT broker accepting all clients,
+// for running without external services
+type Broker struct {
+	// Address is the TCP listening address, like :1883
+	Address string
+	// WebSocketAddress is the optional WebSocket listening address
+	WebSocketAddress string
+	// Verbose logs connections of clients
+	Verbose bool
+
+	server *mochi.Server
+}
+
+// Start starts the broker
+func (b *Broker) Start() error {
+	level := zerolog.ErrorLevel
+	if b.Verbose {
+		level = zerolog.InfoLevel
+	}
+	log := zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).
+		With().Timestamp().Logger().Level(level)
+	server := mochi.New(&mochi.Options{Logger: &log})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		return err
+	}
+	if err := server.AddListener(listeners.NewTCP("tcp", b.Address, nil)); err != nil {
+		return err
+	}
+	if b.WebSocketAddress != "" {
+		if err := server.AddListener(listeners.NewWebsocket("ws", b.WebSocketAddress, nil)); err != nil {
+			server.Close()
+			return err
+		}
+	}
+	if err := server.Serve(); err != nil {
+		server.Close()
+		return err
+	}
+	b.server = server
+	return nil
+}
+
+// Close stops the broker
+func (b *Broker) Close() error {
+	if b.server == nil {
+		return nil
+	}
+	return b.server.Close()
+}
+
+// SourceURL returns the URL for connecting MsgSource to the broker
+func (b *Broker) SourceURL(prefix string) string {
+	host, port, err := net.SplitHostPort(b.Address)
+	if err != nil {
+		host, port = b.Address, "1883"
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return "mqtt://" + net.JoinHostPort(host, port) + "/" + prefix
+}
@@ -2,10 +2,18 @@ package mqtt
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
 	"io"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	paho5 "github.com/eclipse/paho.golang/paho"
 	paho "github.com/eclipse/paho.mqtt.golang"
 	"github.com/robotalks/see/pkg/vis"
 	"github.com/rs/xid"
@@ -16,6 +24,33 @@ const (
 	MessagesTopic = "msgs"
 	// EventsTopic is the topic name for events
 	EventsTopic = "events"
+	// ObjectsTopic is the topic prefix for per-object topics,
+	// <prefix>/objects/<id> carries the object body
+	ObjectsTopic = "objects"
+	// DataTopic is the topic prefix for per-data topics,
+	// <prefix>/data/<id> carries the data value
+	DataTopic = "data"
+	// StatusTopic is the topic name for visualizer presence,
+	// it's retained "online" when connected and "offline" as last will
+	StatusTopic = "status"
+
+	// StatusOnline is the payload on StatusTopic when connected
+	StatusOnline = "online"
+	// StatusOffline is the payload on StatusTopic when disconnected
+	StatusOffline = "offline"
+)
+
+// Mode selects the topics to subscribe
+type Mode string
+
+// Modes
+const (
+	// ModeMsgs subscribes MessagesTopic for batches of messages
+	ModeMsgs Mode = "msgs"
+	// ModeTopics subscribes per-object ObjectsTopic and DataTopic
+	ModeTopics Mode = "topics"
+	// ModeAll subscribes both
+	ModeAll Mode = "all"
 )
 
 // MsgSource processes messages from MQTT bus
@@ -23,17 +58,89 @@ type MsgSource struct {
 	Server   *url.URL
 	Prefix   string
 	ClientID string
-	Client   paho.Client
+	// Client is the MQTT v3 client, unused with MQTT v5
+	Client paho.Client
+
+	// Version is the protocol version, 3 (default) or 5
+	Version int
+
+	// Mode selects the topics to subscribe, default is ModeMsgs
+	Mode Mode
+	// MsgsQoS is the QoS for subscribing MessagesTopic, ObjectsTopic and DataTopic
+	MsgsQoS byte
+	// EventsQoS is the QoS for publishing EventsTopic
+	EventsQoS byte
+	// EventsRetain publishes events as retained messages
+	EventsRetain bool
+	// TLSConfig is used for ssl:// and mqtts:// servers
+	TLSConfig *tls.Config
+	// KeepAlive is the keep-alive interval, 0 for default
+	KeepAlive time.Duration
+	// MaxReconnectInterval limits the backoff of reconnecting, 0 for default
+	MaxReconnectInterval time.Duration
+	// PublishState republishes merged world state under StateTopic
+	PublishState bool
+	// StateQoS is the QoS for publishing state
+	StateQoS byte
+	// SnapshotInterval is the interval of publishing state snapshots
+	SnapshotInterval time.Duration
 
-	msgCh chan paho.Message
+	msgCh    chan *message
+	statusCh chan vis.Msg
+	statePub *StatePublisher
+	v5       *v5Conn
 }
 
-// NewMsgSourceFromURL creates a MsgSource by parsing a URL
+// message is a received message, props is only present with MQTT v5
+type message struct {
+	topic   string
+	payload []byte
+	props   *paho5.PublishProperties
+}
+
+// NewMsgSourceFromURL creates a MsgSource by parsing a URL.
+// Schemes mqtt:// and tcp:// are plain connections, mqtts://, ssl://
+// and tls:// are TLS connections. Schemes mqtt5:// and mqtts5:// select
+// MQTT v5. Options are accepted as query parameters:
+//
+//	version        protocol version, 3 or 5
+//	mode           msgs, topics (per-object topics) or all
+//	qos            QoS for subscriptions
+//	events-qos     QoS for publishing events
+//	events-retain  publish events as retained messages
+//	keepalive      keep-alive interval, like 30s
+//	reconnect-max  maximum interval between reconnecting attempts
+//	ca             CA certificate file for verifying server
+//	cert, key      client certificate and key files
+//	insecure       skip verifying server certificate
+//	publish-state  republish merged world state on <prefix>/state
+//	state-qos      QoS for publishing state
+//	snapshot       interval of publishing state snapshots, like 10s
 func NewMsgSourceFromURL(serverURL string) (s *MsgSource, err error) {
 	s = &MsgSource{}
 	if s.Server, err = url.Parse(serverURL); err != nil {
 		return
 	}
+	switch s.Server.Scheme {
+	case "mqtt", "tcp":
+		s.Server.Scheme = "tcp"
+	case "mqtts", "ssl", "tls":
+		s.Server.Scheme = "ssl"
+		s.TLSConfig = &tls.Config{}
+	case "mqtt5":
+		s.Server.Scheme = "tcp"
+		s.Version = 5
+	case "mqtts5":
+		s.Server.Scheme = "ssl"
+		s.Version = 5
+		s.TLSConfig = &tls.Config{}
+	default:
+		return nil, fmt.Errorf("unsupported scheme %s", s.Server.Scheme)
+	}
+	if err = s.parseOptions(s.Server.Query()); err != nil {
+		return nil, err
+	}
+	s.Server.RawQuery = ""
 	s.Prefix = strings.Trim(s.Server.Path, "/")
 	if s.Prefix != "" {
 		s.Prefix += "/"
@@ -41,10 +148,116 @@ func NewMsgSourceFromURL(serverURL string) (s *MsgSource, err error) {
 	return
 }
 
+func (s *MsgSource) parseOptions(q url.Values) (err error) {
+	parseQoS := func(name string) (byte, error) {
+		str := q.Get(name)
+		if str == "" {
+			return 0, nil
+		}
+		qos, e := strconv.ParseUint(str, 10, 8)
+		if e != nil || qos > 2 {
+			return 0, fmt.Errorf("invalid %s: %s", name, str)
+		}
+		return byte(qos), nil
+	}
+	parseDuration := func(name string) (time.Duration, error) {
+		if str := q.Get(name); str != "" {
+			return time.ParseDuration(str)
+		}
+		return 0, nil
+	}
+	switch ver := q.Get("version"); ver {
+	case "":
+	case "3", "3.1.1":
+		s.Version = 3
+	case "5":
+		s.Version = 5
+	default:
+		return fmt.Errorf("invalid version: %s", ver)
+	}
+	switch mode := Mode(q.Get("mode")); mode {
+	case "", ModeMsgs, ModeTopics, ModeAll:
+		s.Mode = mode
+	default:
+		return fmt.Errorf("invalid mode: %s", mode)
+	}
+	if s.MsgsQoS, err = parseQoS("qos"); err != nil {
+		return
+	}
+	if s.EventsQoS, err = parseQoS("events-qos"); err != nil {
+		return
+	}
+	if str := q.Get("events-retain"); str != "" {
+		if s.EventsRetain, err = strconv.ParseBool(str); err != nil {
+			return fmt.Errorf("invalid events-retain: %s", str)
+		}
+	}
+	if s.KeepAlive, err = parseDuration("keepalive"); err != nil {
+		return
+	}
+	if s.MaxReconnectInterval, err = parseDuration("reconnect-max"); err != nil {
+		return
+	}
+	if str := q.Get("publish-state"); str != "" {
+		if s.PublishState, err = strconv.ParseBool(str); err != nil {
+			return fmt.Errorf("invalid publish-state: %s", str)
+		}
+	}
+	if s.StateQoS, err = parseQoS("state-qos"); err != nil {
+		return
+	}
+	if s.SnapshotInterval, err = parseDuration("snapshot"); err != nil {
+		return
+	}
+	if s.SnapshotInterval > 0 {
+		s.PublishState = true
+	}
+
+	ca, cert, key, insecure := q.Get("ca"), q.Get("cert"), q.Get("key"), q.Get("insecure")
+	if ca == "" && cert == "" && key == "" && insecure == "" {
+		return nil
+	}
+	if s.TLSConfig == nil {
+		return fmt.Errorf("TLS options require mqtts:// or ssl://")
+	}
+	if ca != "" {
+		pem, e := os.ReadFile(ca)
+		if e != nil {
+			return e
+		}
+		s.TLSConfig.RootCAs = x509.NewCertPool()
+		if !s.TLSConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", ca)
+		}
+	}
+	if cert != "" || key != "" {
+		if cert == "" || key == "" {
+			return fmt.Errorf("both cert and key are required")
+		}
+		pair, e := tls.LoadX509KeyPair(cert, key)
+		if e != nil {
+			return e
+		}
+		s.TLSConfig.Certificates = []tls.Certificate{pair}
+	}
+	if insecure != "" {
+		if s.TLSConfig.InsecureSkipVerify, err = strconv.ParseBool(insecure); err != nil {
+			return fmt.Errorf("invalid insecure: %s", insecure)
+		}
+	}
+	return nil
+}
+
 // Connect connects to MQTT
 func (s *MsgSource) Connect() error {
 	if s.msgCh == nil {
-		s.msgCh = make(chan paho.Message)
+		s.msgCh = make(chan *message)
+	}
+	if s.statusCh == nil {
+		s.statusCh = make(chan vis.Msg, 16)
+	}
+	if s.Version == 5 {
+		return s.connectV5()
 	}
 	if s.Client == nil {
 		opts := paho.NewClientOptions()
@@ -59,6 +272,20 @@ func (s *MsgSource) Connect() error {
 		if opts.ClientID == "" {
 			opts.ClientID = xid.New().String()
 		}
+		if s.TLSConfig != nil {
+			opts.SetTLSConfig(s.TLSConfig)
+		}
+		if s.KeepAlive > 0 {
+			opts.SetKeepAlive(s.KeepAlive)
+		}
+		if s.MaxReconnectInterval > 0 {
+			opts.SetMaxReconnectInterval(s.MaxReconnectInterval)
+		}
+		opts.SetAutoReconnect(true)
+		opts.SetWill(s.Prefix+StatusTopic, StatusOffline, 1, true)
+		opts.SetOnConnectHandler(s.onConnect)
+		opts.SetConnectionLostHandler(s.onConnectionLost)
+		opts.SetReconnectingHandler(s.onReconnecting)
 		s.Client = paho.NewClient(opts)
 	}
 	if s.Client.IsConnected() {
@@ -66,38 +293,139 @@ func (s *MsgSource) Connect() error {
 	}
 	token := s.Client.Connect()
 	token.Wait()
-	if err := token.Error(); err != nil {
-		return err
+	return token.Error()
+}
+
+// subscriptions returns topic filters to subscribe according to Mode
+func (s *MsgSource) subscriptions() map[string]byte {
+	filters := make(map[string]byte)
+	if s.Mode != ModeTopics {
+		filters[s.Prefix+MessagesTopic] = s.MsgsQoS
 	}
-	token = s.Client.Subscribe(s.Prefix+MessagesTopic, 0, s.messageHandler)
+	if s.Mode == ModeTopics || s.Mode == ModeAll {
+		// retained messages on these topics rebuild the full world
+		filters[s.Prefix+ObjectsTopic+"/#"] = s.MsgsQoS
+		filters[s.Prefix+DataTopic+"/#"] = s.MsgsQoS
+	}
+	return filters
+}
+
+// onConnect subscribes on every connection, as a clean session
+// loses subscriptions when the broker drops the connection
+func (s *MsgSource) onConnect(client paho.Client) {
+	token := client.SubscribeMultiple(s.subscriptions(), s.messageHandler)
 	token.Wait()
-	return token.Error()
+	if err := token.Error(); err != nil {
+		s.reportStatus(false, fmt.Sprintf("subscribe error: %v", err))
+		return
+	}
+	client.Publish(s.Prefix+StatusTopic, 1, true, StatusOnline)
+	s.connected()
+}
+
+// connected finishes a (re)connection after subscribing
+func (s *MsgSource) connected() {
+	s.reportStatus(true, "")
+	if pub := s.statePub; pub != nil {
+		// retained state may be lost if the broker restarted
+		if err := pub.PublishAll(); err != nil {
+			fmt.Fprintf(os.Stderr, "mqtt publish state: %v\n", err)
+		}
+	}
+}
+
+func (s *MsgSource) onConnectionLost(_ paho.Client, err error) {
+	s.reportStatus(false, fmt.Sprintf("connection lost: %v", err))
+}
+
+func (s *MsgSource) onReconnecting(paho.Client, *paho.ClientOptions) {
+	s.reportStatus(false, "reconnecting")
+}
+
+func (s *MsgSource) reportStatus(connected bool, detail string) {
+	msg := vis.StatusMsg("mqtt", connected, detail)
+	select {
+	case s.statusCh <- msg:
+	default:
+	}
 }
 
 func (s *MsgSource) messageHandler(_ paho.Client, msg paho.Message) {
-	s.msgCh <- msg
+	s.msgCh <- &message{topic: msg.Topic(), payload: msg.Payload()}
+}
+
+// publish publishes a message if connected
+func (s *MsgSource) publish(topic string, qos byte, retain bool, payload []byte) {
+	if s.v5 != nil {
+		s.v5.publish(topic, qos, retain, payload, nil)
+	} else if client := s.Client; client != nil && client.IsConnected() {
+		client.Publish(topic, qos, retain, payload)
+	}
 }
 
 // RecvMessages implements vis.MessageSink
 func (s *MsgSource) RecvMessages(msgs []vis.Msg) {
-	if client := s.Client; client != nil && client.IsConnected() {
-		client.Publish(s.Prefix+EventsTopic, 0, false,
-			[]byte(string(vis.MustEncode(msgs))))
+	payload := vis.MustEncode(msgs)
+	if s.v5 != nil {
+		s.v5.publishEvents(payload)
+	} else {
+		s.publish(s.Prefix+EventsTopic, s.EventsQoS, s.EventsRetain, payload)
 	}
 }
 
+// SourceStatus implements vis.StatusReporter
+func (s *MsgSource) SourceStatus() vis.SourceStatus {
+	status := vis.SourceStatus{
+		Kind:    "mqtt",
+		Details: map[string]interface{}{"prefix": s.Prefix, "client-id": s.ClientID},
+	}
+	if s.Server != nil {
+		status.Address = s.Server.Redacted()
+	}
+	if s.v5 != nil {
+		status.Connected = s.v5.isConnected()
+		status.Details["version"] = 5
+	} else if client := s.Client; client != nil {
+		status.Connected = client.IsConnectionOpen()
+	}
+	return status
+}
+
 // ProcessMessages implements vis.MsgSource
 func (s *MsgSource) ProcessMessages(sink vis.MessageSink) error {
+	metrics := vis.SinkMetrics(sink)
 	for {
-		msg, ok := <-s.msgCh
+		var msg *message
+		var ok bool
+		select {
+		case status := <-s.statusCh:
+			sink.RecvMessages([]vis.Msg{status})
+			continue
+		case msg, ok = <-s.msgCh:
+		}
 		if !ok {
 			return io.EOF
 		}
-		decoder := vis.NewMsgDecoder(bytes.NewBuffer(msg.Payload()))
+		meta := metadata(msg.props)
+		if msg.topic != s.Prefix+MessagesTopic && msg.topic != s.Prefix+ResponsesTopic {
+			msgs, err := s.topicMessages(msg.topic, msg.payload)
+			if err != nil {
+				metrics.SourceDecodeError("mqtt")
+				fmt.Fprintf(os.Stderr, "mqtt topic %s: %v\n", msg.topic, err)
+			} else if len(msgs) > 0 {
+				metrics.SourceReceived("mqtt", msgs)
+				sink.RecvMessages(withMetadata(msgs, meta))
+			}
+			continue
+		}
+		decoder := vis.NewMsgDecoder(bytes.NewBuffer(msg.payload))
 		for {
 			if msgs, err := decoder.Decode(); err == nil {
+				metrics.SourceReceived("mqtt", msgs)
+				msgs = withMetadata(msgs, meta)
 				sink.RecvMessages(msgs)
 			} else if err != io.EOF {
+				metrics.SourceDecodeError("mqtt")
 				return err
 			} else {
 				break
@@ -105,3 +433,39 @@ func (s *MsgSource) ProcessMessages(sink vis.MessageSink) error {
 		}
 	}
 }
+
+// topicMessages converts a message on per-object topics into
+// visualizer messages, an empty or null payload removes the object, and
+// an empty payload clears the data value without touching the object
+func (s *MsgSource) topicMessages(topic string, payload []byte) ([]vis.Msg, error) {
+	path := strings.TrimPrefix(topic, s.Prefix)
+	var kind, id string
+	if pos := strings.IndexByte(path, '/'); pos > 0 {
+		kind, id = path[:pos], path[pos+1:]
+	}
+	if id == "" || (kind != ObjectsTopic && kind != DataTopic) {
+		return nil, nil
+	}
+	empty := len(bytes.TrimSpace(payload)) == 0
+	if kind == DataTopic {
+		if empty {
+			return []vis.Msg{vis.DataValueMsg(id, vis.DataValue("null"))}, nil
+		}
+		if !json.Valid(payload) {
+			return nil, fmt.Errorf("invalid JSON value")
+		}
+		return []vis.Msg{vis.DataValueMsg(id, vis.DataValue(payload))}, nil
+	}
+	var obj vis.Object
+	if !empty {
+		if err := json.Unmarshal(payload, &obj); err != nil {
+			return nil, err
+		}
+	}
+	// null is also taken as clearing a retained object
+	if obj == nil {
+		return []vis.Msg{{vis.PropAction: vis.ActionRemove, vis.PropID: id}}, nil
+	}
+	obj[vis.PropID] = id
+	return []vis.Msg{vis.ObjectMsg(obj)}, nil
+}
@@ -0,0 +1,168 @@
+package mqtt
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/robotalks/see/pkg/vis"
+)
+
+const (
+	// StateTopic is the topic prefix for republished world state.
+	// Objects and data values are retained on <prefix>/state/objects/<id>
+	// and <prefix>/state/data/<id>, the same layout as ModeTopics,
+	// so another visualizer can consume it with prefix <prefix>/state.
+	StateTopic = "state"
+	// SnapshotTopic is the topic name under StateTopic for snapshots
+	SnapshotTopic = "snapshot"
+)
+
+// Snapshot is the payload published on SnapshotTopic
+type Snapshot struct {
+	Time    int64                    `json:"time"`
+	Objects map[string]vis.Object    `json:"objects"`
+	Data    map[string]vis.DataValue `json:"data"`
+}
+
+// StatePublisher republishes the merged world state held by a
+// vis.StateStore to the broker. It's a vis.MessageSink expected to be
+// registered as an observer of vis.Server.
+type StatePublisher struct {
+	Source *MsgSource
+	States vis.StateStore
+	QoS    byte
+	// SnapshotInterval is the interval of publishing snapshots,
+	// 0 disables snapshots
+	SnapshotInterval time.Duration
+
+	lock      sync.Mutex
+	published map[string]bool
+}
+
+// NewStatePublisher creates a StatePublisher and hooks it to the source
+func (s *MsgSource) NewStatePublisher(states vis.StateStore) *StatePublisher {
+	p := &StatePublisher{
+		Source:           s,
+		States:           states,
+		QoS:              s.StateQoS,
+		SnapshotInterval: s.SnapshotInterval,
+	}
+	s.statePub = p
+	return p
+}
+
+func (p *StatePublisher) topic(kind, id string) string {
+	return p.Source.Prefix + StateTopic + "/" + kind + "/" + id
+}
+
+func (p *StatePublisher) publish(topic string, payload []byte) {
+	p.Source.publish(topic, p.QoS, true, payload)
+}
+
+func (p *StatePublisher) publishObject(obj vis.Object) {
+	id := obj.ID()
+	p.published[ObjectsTopic+"/"+id] = true
+	p.publish(p.topic(ObjectsTopic, id), vis.MustEncode(obj))
+}
+
+func (p *StatePublisher) publishData(id string, val vis.DataValue) {
+	p.published[DataTopic+"/"+id] = true
+	p.publish(p.topic(DataTopic, id), []byte(val))
+}
+
+func (p *StatePublisher) clear(key string) {
+	if p.published[key] {
+		delete(p.published, key)
+		p.publish(p.Source.Prefix+StateTopic+"/"+key, nil)
+	}
+}
+
+// RecvMessages implements vis.MessageSink
+func (p *StatePublisher) RecvMessages(msgs []vis.Msg) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.published == nil {
+		p.published = make(map[string]bool)
+	}
+	for _, msg := range msgs {
+		switch msg.Action() {
+		case vis.ActionReset:
+			for key := range p.published {
+				p.clear(key)
+			}
+		case vis.ActionObject:
+			if obj := msg.Object(); obj != nil && obj.ID() != "" {
+				p.publishObject(obj)
+			}
+		case vis.ActionData:
+			if id, val := msg.ID(), msg.Value(); id != "" && val != nil {
+				p.publishData(id, val)
+			}
+		case vis.ActionRemove:
+			if id := msg.ID(); id != "" {
+				p.clear(ObjectsTopic + "/" + id)
+				p.clear(DataTopic + "/" + id)
+			}
+		}
+	}
+}
+
+// PublishAll republishes the full state, used after (re)connecting
+func (p *StatePublisher) PublishAll() error {
+	objs, err := p.States.Objects()
+	if err != nil {
+		return err
+	}
+	data, err := p.States.DataValues()
+	if err != nil {
+		return err
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.published == nil {
+		p.published = make(map[string]bool)
+	}
+	for _, obj := range objs {
+		p.publishObject(obj)
+	}
+	for id, val := range data {
+		p.publishData(id, val)
+	}
+	return nil
+}
+
+// PublishSnapshot publishes the full state as one retained message
+func (p *StatePublisher) PublishSnapshot() error {
+	snapshot := &Snapshot{Time: time.Now().UnixNano() / int64(time.Millisecond)}
+	var err error
+	if snapshot.Objects, err = p.States.Objects(); err != nil {
+		return err
+	}
+	if snapshot.Data, err = p.States.DataValues(); err != nil {
+		return err
+	}
+	p.publish(p.Source.Prefix+StateTopic+"/"+SnapshotTopic, vis.MustEncode(snapshot))
+	return nil
+}
+
+// Run publishes snapshots periodically until done is closed,
+// a nil done runs forever
+func (p *StatePublisher) Run(done <-chan struct{}) {
+	if p.SnapshotInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(p.SnapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := p.PublishSnapshot(); err != nil {
+				fmt.Fprintf(os.Stderr, "mqtt publish snapshot: %v\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	paho5 "github.com/eclipse/paho.golang/paho"
+	"github.com/robotalks/see/pkg/vis"
+	"github.com/rs/xid"
+)
+
+const (
+	// ResponsesTopic is the topic name for responses to events (MQTT v5).
+	// Events are published with it as the response topic and the sequence
+	// number as correlation data, responses carry messages like MessagesTopic.
+	ResponsesTopic = "responses"
+
+	// PropMeta is the field in vis.Msg holding MQTT v5 metadata:
+	// user properties and the following properties
+	PropMeta = "meta"
+	// MetaContentType is the content type property
+	MetaContentType = "content-type"
+	// MetaResponseTopic is the response topic property
+	MetaResponseTopic = "response-topic"
+	// MetaCorrelationData is the correlation data property
+	MetaCorrelationData = "correlation-data"
+	// MetaSource is the user property of the publisher ID
+	MetaSource = "source"
+	// MetaSeq is the user property of the sequence number
+	MetaSeq = "seq"
+
+	// ContentTypeJSON is the content type of published events
+	ContentTypeJSON = "application/json"
+)
+
+// Timeouts of MQTT v5 operations
+var (
+	ConnectTimeout = 10 * time.Second
+	PublishTimeout = 5 * time.Second
+)
+
+// v5Conn is the connection using MQTT v5
+type v5Conn struct {
+	source   *MsgSource
+	clientID string
+	up       int32
+	seq      uint64
+
+	lock sync.Mutex
+	cm   *autopaho.ConnectionManager
+}
+
+func (s *MsgSource) connectV5() error {
+	if s.v5 != nil {
+		return nil
+	}
+	c := &v5Conn{source: s, clientID: s.ClientID}
+	if c.clientID == "" {
+		c.clientID = xid.New().String()
+	}
+	keepAlive := s.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = 30 * time.Second
+	}
+	cfg := autopaho.ClientConfig{
+		BrokerUrls:     []*url.URL{s.Server},
+		TlsCfg:         s.TLSConfig,
+		KeepAlive:      uint16(keepAlive / time.Second),
+		ConnectTimeout: ConnectTimeout,
+		OnConnectionUp: c.onConnectionUp,
+		OnConnectError: func(err error) {
+			s.reportStatus(false, err.Error())
+		},
+		ClientConfig: paho5.ClientConfig{
+			ClientID: c.clientID,
+			Router:   paho5.NewSingleHandlerRouter(c.messageHandler),
+			OnClientError: func(err error) {
+				c.down(fmt.Sprintf("connection lost: %v", err))
+			},
+			OnServerDisconnect: func(d *paho5.Disconnect) {
+				c.down(fmt.Sprintf("disconnected by server, reason %d", d.ReasonCode))
+			},
+		},
+	}
+	if s.MaxReconnectInterval > 0 {
+		cfg.ConnectRetryDelay = s.MaxReconnectInterval
+	}
+	if user := s.Server.User; user != nil {
+		pwd, _ := user.Password()
+		cfg.SetUsernamePassword(user.Username(), []byte(pwd))
+	}
+	cfg.SetWillMessage(s.Prefix+StatusTopic, []byte(StatusOffline), 1, true)
+	s.v5 = c
+	cm, err := autopaho.NewConnection(context.Background(), cfg)
+	if err != nil {
+		s.v5 = nil
+		return err
+	}
+	c.setManager(cm)
+	ctx, cancel := context.WithTimeout(context.Background(), ConnectTimeout)
+	defer cancel()
+	if err = cm.AwaitConnection(ctx); err != nil {
+		return fmt.Errorf("connect %s: %w", s.Server.Redacted(), err)
+	}
+	return nil
+}
+
+func (c *v5Conn) setManager(cm *autopaho.ConnectionManager) {
+	c.lock.Lock()
+	c.cm = cm
+	c.lock.Unlock()
+}
+
+func (c *v5Conn) manager() *autopaho.ConnectionManager {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.cm
+}
+
+// onConnectionUp subscribes on every connection like MsgSource.onConnect
+func (c *v5Conn) onConnectionUp(cm *autopaho.ConnectionManager, _ *paho5.Connack) {
+	c.setManager(cm)
+	s := c.source
+	sub := &paho5.Subscribe{Subscriptions: make(map[string]paho5.SubscribeOptions)}
+	for topic, qos := range s.subscriptions() {
+		sub.Subscriptions[topic] = paho5.SubscribeOptions{QoS: qos}
+	}
+	sub.Subscriptions[s.Prefix+ResponsesTopic] = paho5.SubscribeOptions{QoS: s.MsgsQoS}
+	ctx, cancel := context.WithTimeout(context.Background(), PublishTimeout)
+	defer cancel()
+	if _, err := cm.Subscribe(ctx, sub); err != nil {
+		s.reportStatus(false, fmt.Sprintf("subscribe error: %v", err))
+		return
+	}
+	atomic.StoreInt32(&c.up, 1)
+	c.publish(s.Prefix+StatusTopic, 1, true, []byte(StatusOnline), nil)
+	s.connected()
+}
+
+func (c *v5Conn) down(detail string) {
+	atomic.StoreInt32(&c.up, 0)
+	c.source.reportStatus(false, detail)
+}
+
+func (c *v5Conn) isConnected() bool {
+	return atomic.LoadInt32(&c.up) != 0
+}
+
+func (c *v5Conn) messageHandler(p *paho5.Publish) {
+	c.source.msgCh <- &message{topic: p.Topic, payload: p.Payload, props: p.Properties}
+}
+
+func (c *v5Conn) publish(topic string, qos byte, retain bool, payload []byte, props *paho5.PublishProperties) {
+	cm := c.manager()
+	if cm == nil || !c.isConnected() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), PublishTimeout)
+	defer cancel()
+	_, err := cm.Publish(ctx, &paho5.Publish{
+		Topic:      topic,
+		QoS:        qos,
+		Retain:     retain,
+		Payload:    payload,
+		Properties: props,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mqtt publish %s: %v\n", topic, err)
+	}
+}
+
+// publishEvents publishes events as requests, responses are expected
+// on ResponsesTopic with the same correlation data
+func (c *v5Conn) publishEvents(payload []byte) {
+	s := c.source
+	seq := strconv.FormatUint(atomic.AddUint64(&c.seq, 1), 10)
+	props := &paho5.PublishProperties{
+		ContentType:     ContentTypeJSON,
+		ResponseTopic:   s.Prefix + ResponsesTopic,
+		CorrelationData: []byte(seq),
+		User: paho5.UserProperties{
+			{Key: MetaSource, Value: c.clientID},
+			{Key: MetaSeq, Value: seq},
+		},
+	}
+	c.publish(s.Prefix+EventsTopic, s.EventsQoS, s.EventsRetain, payload, props)
+}
+
+// metadata extracts MQTT v5 properties, nil without properties
+func metadata(props *paho5.PublishProperties) map[string]interface{} {
+	if props == nil {
+		return nil
+	}
+	meta := make(map[string]interface{})
+	for _, prop := range props.User {
+		if prop.Key == MetaSeq {
+			if seq, err := strconv.ParseInt(prop.Value, 10, 64); err == nil {
+				meta[prop.Key] = seq
+				continue
+			}
+		}
+		meta[prop.Key] = prop.Value
+	}
+	if props.ContentType != "" {
+		meta[MetaContentType] = props.ContentType
+	}
+	if props.ResponseTopic != "" {
+		meta[MetaResponseTopic] = props.ResponseTopic
+	}
+	if data := props.CorrelationData; len(data) > 0 {
+		if utf8.Valid(data) {
+			meta[MetaCorrelationData] = string(data)
+		} else {
+			meta[MetaCorrelationData] = base64.StdEncoding.EncodeToString(data)
+		}
+	}
+	if len(meta) == 0 {
+		return nil
+	}
+	return meta
+}
+
+// withMetadata attaches metadata to messages as PropMeta
+func withMetadata(msgs []vis.Msg, meta map[string]interface{}) []vis.Msg {
+	if meta != nil {
+		for _, msg := range msgs {
+			msg[PropMeta] = meta
+		}
+	}
+	return msgs
+}
@@ -0,0 +1,407 @@
+package vis
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// BuiltinTypes are object types rendered by the embedded web content
+var BuiltinTypes = []string{
+	"camera", "chart", "corner", "dot", "image", "joystick", "label",
+	"slider", "toggle",
+}
+
+// PluginDependency declares a plugin required by another plugin
+type PluginDependency struct {
+	Name string `json:"name" yaml:"name"`
+	// Version is a constraint like ">=1.2", "^1.0", "~1.2.3", "1.2.3",
+	// multiple constraints are separated by space or comma
+	Version string `json:"version,omitempty" yaml:"version"`
+}
+
+// Version is a parsed MAJOR.MINOR.PATCH version
+type Version [3]int
+
+// ParseVersion parses a version like "1", "1.2", "v1.2.3", pre-release
+// and build suffixes are ignored
+func ParseVersion(s string) (v Version, err error) {
+	str := strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if pos := strings.IndexAny(str, "-+"); pos >= 0 {
+		str = str[:pos]
+	}
+	parts := strings.Split(str, ".")
+	if str == "" || len(parts) > 3 {
+		return v, fmt.Errorf("invalid version %q", s)
+	}
+	for n, part := range parts {
+		if v[n], err = strconv.Atoi(part); err != nil || v[n] < 0 {
+			return v, fmt.Errorf("invalid version %q", s)
+		}
+	}
+	return v, nil
+}
+
+// Compare returns -1, 0, 1 if v is less than, equal to, greater than o
+func (v Version) Compare(o Version) int {
+	for n := range v {
+		if v[n] < o[n] {
+			return -1
+		}
+		if v[n] > o[n] {
+			return 1
+		}
+	}
+	return 0
+}
+
+// String implements fmt.Stringer
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])
+}
+
+// MatchVersion checks a version against a constraint
+func MatchVersion(constraint, version string) (bool, error) {
+	terms := strings.FieldsFunc(constraint, func(r rune) bool {
+		return r == ' ' || r == ','
+	})
+	if len(terms) == 0 {
+		return true, nil
+	}
+	v, err := ParseVersion(version)
+	if err != nil {
+		return false, err
+	}
+	for _, term := range terms {
+		if term == "*" {
+			continue
+		}
+		pos := strings.IndexAny(term, "v0123456789")
+		if pos < 0 {
+			return false, fmt.Errorf("invalid version constraint %q", term)
+		}
+		op := term[:pos]
+		c, err := ParseVersion(term[pos:])
+		if err != nil {
+			return false, err
+		}
+		cmp := v.Compare(c)
+		var ok bool
+		switch op {
+		case "", "=", "==":
+			ok = cmp == 0
+		case ">":
+			ok = cmp > 0
+		case ">=":
+			ok = cmp >= 0
+		case "<":
+			ok = cmp < 0
+		case "<=":
+			ok = cmp <= 0
+		case "!=":
+			ok = cmp != 0
+		case "^":
+			ok = cmp >= 0 && v[0] == c[0]
+		case "~":
+			ok = cmp >= 0 && v[0] == c[0] && v[1] == c[1]
+		default:
+			return false, fmt.Errorf("invalid version constraint %q", term)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Validate checks the manifest against the content of plugin
+func (m *PluginManifest) Validate(fsys fs.FS) error {
+	var errs []string
+	if m.Version != "" {
+		if _, err := ParseVersion(m.Version); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	for _, dep := range m.Requires {
+		if dep.Name == "" {
+			errs = append(errs, "requires: missing name")
+		} else if _, err := MatchVersion(dep.Version, "0"); err != nil {
+			errs = append(errs, fmt.Sprintf("requires %s: %v", dep.Name, err))
+		}
+	}
+	types := make(map[string]bool)
+	for _, t := range m.Types {
+		if t == "" {
+			errs = append(errs, "types: empty type name")
+		}
+		types[t] = true
+	}
+	for t := range m.Defaults {
+		if !types[t] {
+			errs = append(errs, fmt.Sprintf("defaults: type %s not declared in types", t))
+		}
+	}
+	checkFile := func(kind, fn string, wantDir bool) {
+		clean := path.Clean(fn)
+		if !fs.ValidPath(clean) {
+			errs = append(errs, fmt.Sprintf("%s %s: path outside plugin", kind, fn))
+			return
+		}
+		info, err := fs.Stat(fsys, clean)
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Sprintf("%s %s: %v", kind, fn, err))
+		case info.IsDir() != wantDir:
+			errs = append(errs, fmt.Sprintf("%s %s: unexpected file type", kind, fn))
+		}
+	}
+	for _, fn := range m.Visualizer.Stylesheets {
+		checkFile("stylesheet", fn, false)
+	}
+	for _, fn := range m.Visualizer.Scripts {
+		checkFile("script", fn, false)
+	}
+	for _, fn := range m.Assets {
+		checkFile("assets", fn, true)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid manifest: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Serves determines if a file in the plugin directory is exposed.
+// All files are exposed if no asset directories are declared,
+// otherwise only scripts, stylesheets and files in asset directories.
+func (m *PluginManifest) Serves(fn string) bool {
+	if len(m.Assets) == 0 {
+		return true
+	}
+	fn = strings.TrimPrefix(path.Clean("/"+fn), "/")
+	for _, files := range [][]string{m.Visualizer.Stylesheets, m.Visualizer.Scripts} {
+		for _, f := range files {
+			if fn == strings.TrimPrefix(path.Clean("/"+f), "/") {
+				return true
+			}
+		}
+	}
+	for _, d := range m.Assets {
+		if strings.HasPrefix(fn, strings.Trim(path.Clean("/"+d), "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// loadValidManifest loads and validates plugin manifest
+func loadValidManifest(fsys fs.FS) (*PluginManifest, error) {
+	mf, err := LoadPluginManifestFS(fsys)
+	if err == nil {
+		err = mf.Validate(fsys)
+	}
+	return mf, err
+}
+
+// resolvePlugins orders plugins so dependencies come first, plugins
+// with unresolved dependencies are reported in errs and excluded
+func resolvePlugins(plugins []*plugin, manifests map[*plugin]*PluginManifest) (ordered []*plugin, errs map[*plugin]error) {
+	errs = make(map[*plugin]error)
+	byName := make(map[string]*plugin)
+	for _, p := range plugins {
+		byName[p.name] = p
+	}
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	states := make(map[*plugin]int)
+	var visit func(p *plugin) error
+	visit = func(p *plugin) error {
+		switch states[p] {
+		case visiting:
+			return fmt.Errorf("circular dependency on %s", p.name)
+		case visited:
+			return errs[p]
+		}
+		states[p] = visiting
+		var err error
+		mf := manifests[p]
+		if mf == nil {
+			err = fmt.Errorf("manifest not loaded")
+			mf = &PluginManifest{}
+		}
+		for _, dep := range mf.Requires {
+			d := byName[dep.Name]
+			if d == nil {
+				err = fmt.Errorf("requires %s: not loaded", dep.Name)
+				break
+			}
+			if err = visit(d); err != nil {
+				err = fmt.Errorf("requires %s: %v", dep.Name, err)
+				break
+			}
+			ver := manifests[d].Version
+			if dep.Version != "" {
+				ok, e := MatchVersion(dep.Version, ver)
+				if e == nil && !ok {
+					e = fmt.Errorf("version %s does not match %s", ver, dep.Version)
+				}
+				if e != nil {
+					err = fmt.Errorf("requires %s: %v", dep.Name, e)
+					break
+				}
+			}
+		}
+		states[p] = visited
+		if err != nil {
+			errs[p] = err
+			return err
+		}
+		ordered = append(ordered, p)
+		return nil
+	}
+	for _, p := range plugins {
+		visit(p)
+	}
+	return
+}
+
+// ResolvePlugins checks dependencies among loaded plugins
+func (s *Server) ResolvePlugins() error {
+	plugins := s.loadedPlugins()
+	errs := s.resolveErrors(plugins)
+	for _, p := range plugins {
+		if err := errs[p]; err != nil {
+			return fmt.Errorf("%s: %v", p.dir, err)
+		}
+	}
+	return nil
+}
+
+// PluginResolveErrors checks dependencies among loaded plugins, and
+// returns the errors by the directory given to LoadPlugin. Plugins
+// failing to resolve are left out of the page.
+func (s *Server) PluginResolveErrors() map[string]error {
+	errs := make(map[string]error)
+	for p, err := range s.resolveErrors(s.loadedPlugins()) {
+		errs[p.spec] = err
+	}
+	return errs
+}
+
+func (s *Server) resolveErrors(plugins []*plugin) map[*plugin]error {
+	manifests := make(map[*plugin]*PluginManifest)
+	s.pluginsLock.RLock()
+	for _, p := range plugins {
+		manifests[p] = p.manifest
+	}
+	s.pluginsLock.RUnlock()
+	_, errs := resolvePlugins(plugins, manifests)
+	return errs
+}
+
+// objectTypes are known object types and default properties from
+// builtins and plugins, known is nil if any plugin doesn't declare
+// its types
+type objectTypes struct {
+	known    map[string]bool
+	defaults map[string]Object
+}
+
+// objectTypes returns the cached object types, built on the first use
+// after plugins change
+func (s *Server) objectTypes() *objectTypes {
+	s.typesLock.Lock()
+	types, gen := s.types, s.typesGen
+	s.typesLock.Unlock()
+	if types != nil {
+		return types
+	}
+	types = s.buildObjectTypes()
+	s.typesLock.Lock()
+	// plugins changed while building, leave it to the next use
+	if gen == s.typesGen {
+		s.types = types
+	}
+	s.typesLock.Unlock()
+	return types
+}
+
+// invalidateObjectTypes is called when plugins are loaded, reloaded
+// or removed
+func (s *Server) invalidateObjectTypes() {
+	s.typesLock.Lock()
+	s.types = nil
+	s.typesGen++
+	s.typesLock.Unlock()
+}
+
+func (s *Server) buildObjectTypes() *objectTypes {
+	known := make(map[string]bool)
+	defaults := make(map[string]Object)
+	for _, t := range BuiltinTypes {
+		known[t] = true
+	}
+	addDefaults := func(d map[string]Object) {
+		for t, props := range d {
+			if defaults[t] == nil {
+				defaults[t] = make(Object)
+			}
+			for k, v := range props {
+				defaults[t][k] = v
+			}
+		}
+	}
+	for _, b := range s.Builtins {
+		for _, t := range b.Types {
+			known[t] = true
+		}
+		addDefaults(b.Defaults)
+	}
+	declared := true
+	s.pluginsLock.RLock()
+	for _, p := range s.plugins {
+		if p.manifest == nil {
+			continue
+		}
+		if len(p.manifest.Types) == 0 {
+			declared = false
+		}
+		for _, t := range p.manifest.Types {
+			known[t] = true
+		}
+		addDefaults(p.manifest.Defaults)
+	}
+	s.pluginsLock.RUnlock()
+	if !declared {
+		known = nil
+	}
+	return &objectTypes{known: known, defaults: defaults}
+}
+
+// prepareObject applies default properties and warns about object
+// types without a renderer
+func (s *Server) prepareObject(obj Object) {
+	types := s.objectTypes()
+	typ := stringProp(obj, "type")
+	for k, v := range types.defaults[typ] {
+		if _, exist := obj[k]; !exist {
+			obj[k] = v
+		}
+	}
+	if types.known == nil || types.known[typ] {
+		return
+	}
+	s.typesLock.Lock()
+	if s.warnedTypes == nil {
+		s.warnedTypes = make(map[string]bool)
+	}
+	warned := s.warnedTypes[typ]
+	s.warnedTypes[typ] = true
+	s.typesLock.Unlock()
+	if !warned {
+		s.Logger.Warningf("Object %s: no renderer for type %q", obj.ID(), typ)
+	}
+}
@@ -1,11 +1,17 @@
 package vis
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 	"net"
+	"net/url"
 	"os"
 	"os/exec"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // StreamMsgSource implements MsgSource simply using
@@ -14,6 +20,13 @@ import (
 type StreamMsgSource struct {
 	Reader io.Reader
 	Writer io.Writer
+	// Name identifies the source in metrics, default is "stream"
+	Name string
+	// Metrics records the received messages, default is SinkMetrics
+	// of the sink
+	Metrics *Metrics
+
+	done int32
 }
 
 // RecvMessages implements MessageSink
@@ -23,42 +36,149 @@ func (s *StreamMsgSource) RecvMessages(msgs []Msg) {
 
 // ProcessMessages implements MsgSource
 func (s *StreamMsgSource) ProcessMessages(sink MessageSink) error {
+	name, metrics := s.name(), s.Metrics
+	if metrics == nil {
+		metrics = SinkMetrics(sink)
+	}
 	decoder := NewMsgDecoder(s.Reader)
 	for {
 		msgs, err := decoder.Decode()
 		if err != nil {
+			if err != io.EOF {
+				metrics.SourceDecodeError(name)
+			}
+			atomic.StoreInt32(&s.done, 1)
 			return err
 		}
+		metrics.SourceReceived(name, msgs)
 		sink.RecvMessages(msgs)
 	}
 }
 
+// SourceStatus implements StatusReporter
+func (s *StreamMsgSource) SourceStatus() SourceStatus {
+	return SourceStatus{Kind: s.name(), Connected: atomic.LoadInt32(&s.done) == 0}
+}
+
+func (s *StreamMsgSource) name() string {
+	if s.Name == "" {
+		return "stream"
+	}
+	return s.Name
+}
+
+// ListenerProtocolVersion is the latest protocol version of ListenerSource
+const ListenerProtocolVersion = 1
+
+// ActionHello is the optional first message from a ListenerSource client:
+//
+//	{"action": "hello", "name": "arm", "version": 1,
+//	 "actions": ["click"], "types": ["joystick"], "autoremove": true}
+const ActionHello = "hello"
+
+// ClientHello declares a client of ListenerSource
+type ClientHello struct {
+	Name    string `json:"name"`
+	Version int    `json:"version"`
+	// Actions and Types select events by action, or by the type of the
+	// object the event comes from, all events if both are empty
+	Actions []string `json:"actions"`
+	Types   []string `json:"types"`
+	// AutoRemove removes objects created by the client on disconnect
+	AutoRemove bool `json:"autoremove"`
+}
+
+// wants tells if the client is interested in the event on the object type
+func (h *ClientHello) wants(action, objType string) bool {
+	if len(h.Actions) == 0 && len(h.Types) == 0 {
+		return true
+	}
+	for _, a := range h.Actions {
+		if a == action {
+			return true
+		}
+	}
+	for _, t := range h.Types {
+		if objType != "" && t == objType {
+			return true
+		}
+	}
+	return false
+}
+
+// ListenerSource accepts clients sending messages as StreamMsgSource.
+// Without a hello, a client receives all events.
 type ListenerSource struct {
-	ln net.Listener
+	ln          net.Listener
 	clientsLock sync.RWMutex
-	clients map[net.Conn]struct{}
+	clients     map[net.Conn]*listenerClient
+	// objects are created by clients, by ID
+	objects map[string]*clientObject
+}
+
+type listenerClient struct {
+	conn  net.Conn
+	hello *ClientHello
+}
+
+func (c *listenerClient) send(msgs []Msg) {
+	c.conn.Write([]byte(string(MustEncode(msgs)) + "\n"))
+}
+
+type clientObject struct {
+	client  *listenerClient
+	objType string
 }
 
+// NewListenerSource creates a ListenerSource accepting clients from ln
 func NewListenerSource(ln net.Listener) *ListenerSource {
-	return &ListenerSource{ln: ln, clients: make(map[net.Conn]struct{})}
+	return &ListenerSource{
+		ln:      ln,
+		clients: make(map[net.Conn]*listenerClient),
+		objects: make(map[string]*clientObject),
+	}
 }
 
+// RecvMessages implements MessageSink, events are delivered to clients
+// interested, and the clients creating the objects of events
 func (s *ListenerSource) RecvMessages(msgs []Msg) {
 	s.clientsLock.RLock()
-	conns := make([]net.Conn, 0, len(s.clients))
-	for conn := range s.clients {
-		conns = append(conns, conn)
+	if len(s.clients) == 0 {
+		s.clientsLock.RUnlock()
+		return
+	}
+	selected := make(map[*listenerClient][]Msg, len(s.clients))
+	for _, msg := range msgs {
+		var owner *listenerClient
+		var objType string
+		if obj := s.objects[eventObjectID(msg)]; obj != nil {
+			owner, objType = obj.client, obj.objType
+		}
+		for _, c := range s.clients {
+			if c.hello == nil || c == owner || c.hello.wants(msg.Action(), objType) {
+				selected[c] = append(selected[c], msg)
+			}
+		}
 	}
 	s.clientsLock.RUnlock()
-	if len(conns) == 0 {
-		return
+	for c, msgs := range selected {
+		c.send(msgs)
 	}
-	data := []byte(string(MustEncode(msgs)) + "\n")
-	for _, conn := range conns {
-		conn.Write(data)
+}
+
+// eventObjectID finds the object of an event, as the id property, or the
+// id in the property named by the action, like stick.id
+func eventObjectID(msg Msg) string {
+	if id := msg.ID(); id != "" {
+		return id
 	}
+	if props, ok := msg[msg.Action()].(map[string]interface{}); ok {
+		return stringProp(props, PropID)
+	}
+	return ""
 }
 
+// ProcessMessages implements MsgSource
 func (s *ListenerSource) ProcessMessages(sink MessageSink) error {
 	defer s.ln.Close()
 	for {
@@ -66,20 +186,361 @@ func (s *ListenerSource) ProcessMessages(sink MessageSink) error {
 		if err != nil {
 			return io.EOF
 		}
+		c := &listenerClient{conn: conn}
 		s.clientsLock.Lock()
-		s.clients[conn] = struct{}{}
+		s.clients[conn] = c
 		s.clientsLock.Unlock()
-		go s.serveConn(conn, sink)
+		go s.serveConn(c, sink)
+	}
+}
+
+// SourceStatus implements StatusReporter
+func (s *ListenerSource) SourceStatus() SourceStatus {
+	s.clientsLock.RLock()
+	clients := make([]string, 0, len(s.clients))
+	for conn, c := range s.clients {
+		addr := conn.RemoteAddr().String()
+		if strings.HasPrefix(conn.RemoteAddr().Network(), "unix") {
+			// clients of Unix domain sockets are unnamed
+			addr = s.ln.Addr().String()
+		}
+		if c.hello != nil && c.hello.Name != "" {
+			addr = c.hello.Name + "@" + addr
+		}
+		clients = append(clients, addr)
+	}
+	s.clientsLock.RUnlock()
+	return SourceStatus{
+		Kind:      s.ln.Addr().Network(),
+		Address:   s.ln.Addr().String(),
+		Connected: true,
+		Details:   map[string]interface{}{"clients": clients},
 	}
 }
 
-func (s *ListenerSource) serveConn(conn net.Conn, sink MessageSink) {
-	stream := &StreamMsgSource{Reader: conn}
-	stream.ProcessMessages(sink)
+func (s *ListenerSource) serveConn(c *listenerClient, sink MessageSink) {
+	stream := &StreamMsgSource{
+		Reader:  c.conn,
+		Name:    s.ln.Addr().Network(),
+		Metrics: SinkMetrics(sink),
+	}
+	stream.ProcessMessages(SinkMessage(func(msgs []Msg) {
+		if msgs = s.clientMessages(c, msgs); len(msgs) > 0 {
+			sink.RecvMessages(msgs)
+		}
+	}))
 	s.clientsLock.Lock()
-	delete(s.clients, conn)
+	delete(s.clients, c.conn)
+	var removes []Msg
+	for id, obj := range s.objects {
+		if obj.client == c {
+			delete(s.objects, id)
+			if c.hello != nil && c.hello.AutoRemove {
+				removes = append(removes, Msg{PropAction: ActionRemove, PropID: id})
+			}
+		}
+	}
 	s.clientsLock.Unlock()
+	c.conn.Close()
+	if len(removes) > 0 {
+		sink.RecvMessages(removes)
+	}
+}
+
+// clientMessages handles hello and tracks objects created by the client,
+// and returns the messages for the server
+func (s *ListenerSource) clientMessages(c *listenerClient, msgs []Msg) []Msg {
+	out := msgs[:0]
+	for _, msg := range msgs {
+		switch msg.Action() {
+		case ActionHello:
+			s.hello(c, msg)
+			continue
+		case ActionObject:
+			if obj := msg.Object(); obj != nil && obj.ID() != "" {
+				s.clientsLock.Lock()
+				s.objects[obj.ID()] = &clientObject{client: c, objType: stringProp(obj, "type")}
+				s.clientsLock.Unlock()
+			}
+		case ActionRemove:
+			s.clientsLock.Lock()
+			delete(s.objects, msg.ID())
+			s.clientsLock.Unlock()
+		case ActionReset:
+			s.clientsLock.Lock()
+			s.objects = make(map[string]*clientObject)
+			s.clientsLock.Unlock()
+		}
+		out = append(out, msg)
+	}
+	return out
+}
+
+// hello accepts the handshake and replies with the protocol version, or
+// closes the connection on an unsupported version
+func (s *ListenerSource) hello(c *listenerClient, msg Msg) {
+	var hello ClientHello
+	encoded, _ := json.Marshal(msg)
+	if err := json.Unmarshal(encoded, &hello); err != nil {
+		c.send([]Msg{ErrorMsg(s.ln.Addr().Network(), "invalid hello: "+err.Error())})
+		return
+	}
+	if hello.Version > ListenerProtocolVersion {
+		c.send([]Msg{ErrorMsg(s.ln.Addr().Network(), fmt.Sprintf("unsupported protocol version %d", hello.Version))})
+		c.conn.Close()
+		return
+	}
+	s.clientsLock.Lock()
+	c.hello = &hello
+	s.clientsLock.Unlock()
+	c.send([]Msg{{PropAction: ActionHello, "version": ListenerProtocolVersion}})
+}
+
+// ListenUnix listens on a Unix domain socket, and changes the file mode
+// if not 0. A stale socket left by a previous process is removed, and
+// the socket is removed when the listener is closed.
+func ListenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err = os.Chmod(path, mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// FifoMsgSource reads messages from a named pipe like StreamMsgSource.
+// The pipe is opened again when all writers close it, so programs can
+// come and go. Events are discarded as the pipe is read-only.
+type FifoMsgSource struct {
+	Path string
+
+	opened int32
+}
+
+// NewFifoMsgSource creates a FifoMsgSource on an existing named pipe,
+// created by mkfifo
+func NewFifoMsgSource(path string) (*FifoMsgSource, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode()&os.ModeNamedPipe == 0 {
+		return nil, fmt.Errorf("%s is not a named pipe", path)
+	}
+	return &FifoMsgSource{Path: path}, nil
+}
+
+// RecvMessages implements MessageSink
+func (s *FifoMsgSource) RecvMessages(msgs []Msg) {
+}
+
+// ProcessMessages implements MsgSource, it returns nil when writers
+// close the pipe, to be called again. A malformed message, or a partial
+// one from a writer killed while writing, is reported and the rest from
+// the writer is discarded.
+func (s *FifoMsgSource) ProcessMessages(sink MessageSink) error {
+	// blocks until a writer opens the pipe
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	atomic.StoreInt32(&s.opened, 1)
+	defer atomic.StoreInt32(&s.opened, 0)
+	stream := &StreamMsgSource{Reader: f, Name: "fifo"}
+	if err = stream.ProcessMessages(sink); err != io.EOF {
+		fmt.Fprintf(os.Stderr, "fifo %s: %v\n", s.Path, err)
+		if r, ok := sink.(errorReporter); ok {
+			r.ReportError("fifo", err)
+		}
+	}
+	return nil
+}
+
+// errorReporter records errors of sources, like Server
+type errorReporter interface {
+	ReportError(source string, err error)
+}
+
+// SourceStatus implements StatusReporter, connected when a writer has
+// the pipe open
+func (s *FifoMsgSource) SourceStatus() SourceStatus {
+	return SourceStatus{Kind: "fifo", Address: s.Path, Connected: atomic.LoadInt32(&s.opened) != 0}
+}
+
+// Disconnect policies of ConnectMsgSource
+const (
+	// DisconnectReset resets the world when the connection drops
+	DisconnectReset = "reset"
+	// DisconnectPreserve keeps objects until the server updates them
+	DisconnectPreserve = "preserve"
+)
+
+// ConnectMsgSource connects to a server exchanging messages like
+// StreamMsgSource, and reconnects with backoff when the connection
+// fails or drops
+type ConnectMsgSource struct {
+	Address string
+	// Disconnect is the policy when the connection drops, DisconnectReset
+	// by default or DisconnectPreserve
+	Disconnect string
+	// MinReconnectInterval is the first backoff of reconnecting,
+	// doubled on each failure up to MaxReconnectInterval
+	MinReconnectInterval time.Duration
+	MaxReconnectInterval time.Duration
+
+	conn      net.Conn
+	lastErr   error
+	backoff   time.Duration
+	connected int32
+	lock      sync.Mutex
+}
+
+// NewConnectMsgSourceFromURL creates a ConnectMsgSource from a URL like
+// tcp+connect://host:port, with options as query parameters:
+//
+//	disconnect     reset or preserve the world when the connection drops
+//	reconnect-min  first interval of reconnecting, like 500ms
+//	reconnect-max  maximum interval of reconnecting, like 30s
+func NewConnectMsgSourceFromURL(sourceURL string) (*ConnectMsgSource, error) {
+	u, err := url.Parse(sourceURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%s: missing host:port", sourceURL)
+	}
+	query := u.Query()
+	s := &ConnectMsgSource{
+		Address:              u.Host,
+		Disconnect:           query.Get("disconnect"),
+		MinReconnectInterval: 500 * time.Millisecond,
+		MaxReconnectInterval: 30 * time.Second,
+	}
+	switch s.Disconnect {
+	case "":
+		s.Disconnect = DisconnectReset
+	case DisconnectReset, DisconnectPreserve:
+	default:
+		return nil, fmt.Errorf("disconnect must be %s or %s", DisconnectReset, DisconnectPreserve)
+	}
+	for _, opt := range []struct {
+		name string
+		out  *time.Duration
+	}{
+		{"reconnect-min", &s.MinReconnectInterval},
+		{"reconnect-max", &s.MaxReconnectInterval},
+	} {
+		if str := query.Get(opt.name); str != "" {
+			if *opt.out, err = time.ParseDuration(str); err != nil {
+				return nil, fmt.Errorf("%s: %w", opt.name, err)
+			}
+		}
+	}
+	if s.MaxReconnectInterval < s.MinReconnectInterval {
+		s.MaxReconnectInterval = s.MinReconnectInterval
+	}
+	return s, nil
+}
+
+// RecvMessages implements MessageSink, events are dropped when not connected
+func (s *ConnectMsgSource) RecvMessages(msgs []Msg) {
+	s.lock.Lock()
+	conn := s.conn
+	s.lock.Unlock()
+	if conn != nil {
+		conn.Write([]byte(string(MustEncode(msgs)) + "\n"))
+	}
+}
+
+// ProcessMessages implements MsgSource, it serves one connection, or
+// waits for the backoff if the connection fails, and returns nil to be
+// called again
+func (s *ConnectMsgSource) ProcessMessages(sink MessageSink) error {
+	if s.backoff > 0 {
+		time.Sleep(s.backoff)
+	}
+	conn, err := net.DialTimeout("tcp", s.Address, 10*time.Second)
+	if err != nil {
+		s.nextBackoff()
+		s.setConn(nil, err)
+		sink.RecvMessages([]Msg{StatusMsg("tcp+connect", false,
+			fmt.Sprintf("connect failed: %v, retry in %v", err, s.backoff))})
+		return nil
+	}
+	s.backoff = 0
+	s.setConn(conn, nil)
+	sink.RecvMessages([]Msg{StatusMsg("tcp+connect", true, "")})
+
+	stream := &StreamMsgSource{Reader: conn, Name: "tcp"}
+	if err = stream.ProcessMessages(sink); err == io.EOF {
+		err = fmt.Errorf("closed by server")
+	}
 	conn.Close()
+	s.setConn(nil, err)
+	// reconnect after the minimum interval to avoid spinning on a server
+	// closing connections immediately
+	s.backoff = s.MinReconnectInterval
+	msgs := []Msg{StatusMsg("tcp+connect", false, fmt.Sprintf("connection lost: %v", err))}
+	if s.Disconnect != DisconnectPreserve {
+		msgs = append(msgs, Msg{PropAction: ActionReset})
+	}
+	sink.RecvMessages(msgs)
+	return nil
+}
+
+func (s *ConnectMsgSource) nextBackoff() {
+	switch {
+	case s.backoff < s.MinReconnectInterval:
+		s.backoff = s.MinReconnectInterval
+	case s.backoff*2 > s.MaxReconnectInterval:
+		s.backoff = s.MaxReconnectInterval
+	default:
+		s.backoff *= 2
+	}
+}
+
+func (s *ConnectMsgSource) setConn(conn net.Conn, err error) {
+	s.lock.Lock()
+	s.conn, s.lastErr = conn, err
+	s.lock.Unlock()
+	if conn != nil {
+		atomic.StoreInt32(&s.connected, 1)
+	} else {
+		atomic.StoreInt32(&s.connected, 0)
+	}
+}
+
+// SourceStatus implements StatusReporter
+func (s *ConnectMsgSource) SourceStatus() SourceStatus {
+	status := SourceStatus{
+		Kind:      "tcp+connect",
+		Address:   s.Address,
+		Connected: atomic.LoadInt32(&s.connected) != 0,
+	}
+	s.lock.Lock()
+	if s.lastErr != nil {
+		status.Details = map[string]interface{}{"error": s.lastErr.Error()}
+	}
+	s.lock.Unlock()
+	return status
 }
 
 // ExecMsgSource spawns an external process and use stdin/stdout to
@@ -92,6 +553,7 @@ type ExecMsgSource struct {
 // NewExecMsgSource creates a new ExecMsgSource using command line
 func NewExecMsgSource(prog string, args ...string) (s *ExecMsgSource, err error) {
 	s = &ExecMsgSource{Cmd: exec.Command(prog, args...)}
+	s.rw.Name = "exec"
 	if s.rw.Reader, err = s.Cmd.StdoutPipe(); err != nil {
 		return
 	}
@@ -115,6 +577,16 @@ func (s *ExecMsgSource) ProcessMessages(sink MessageSink) error {
 	return s.rw.ProcessMessages(sink)
 }
 
+// SourceStatus implements StatusReporter
+func (s *ExecMsgSource) SourceStatus() SourceStatus {
+	status := s.rw.SourceStatus()
+	status.Address = s.Cmd.Path
+	if p := s.Cmd.Process; p != nil && p.Pid > 0 {
+		status.Details = map[string]interface{}{"pid": p.Pid}
+	}
+	return status
+}
+
 // Close closes direction pipes
 func (s *ExecMsgSource) Close() error {
 	if r := s.rw.Reader; r != nil {
@@ -15,6 +15,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	logger "github.com/op/go-logging"
 	websocket "golang.org/x/net/websocket"
@@ -30,7 +31,15 @@ type PageContext struct {
 
 // PluginManifest is the content of plugin manifest file
 type PluginManifest struct {
-	Name       string      `json:"name" yaml:"name"`
+	Name     string             `json:"name" yaml:"name"`
+	Version  string             `json:"version,omitempty" yaml:"version"`
+	Requires []PluginDependency `json:"requires,omitempty" yaml:"requires"`
+	// Types are object types rendered by the plugin
+	Types []string `json:"types,omitempty" yaml:"types"`
+	// Defaults are default properties per object type
+	Defaults map[string]Object `json:"defaults,omitempty" yaml:"defaults"`
+	// Assets are static asset directories
+	Assets     []string    `json:"assets,omitempty" yaml:"assets"`
 	Visualizer PageContext `json:"visualizer" yaml:"visualizer"`
 }
 
@@ -40,6 +49,8 @@ type Builtin struct {
 	Path       string
 	Visualizer PageContext
 	Handler    http.Handler
+	Types      []string
+	Defaults   map[string]Object
 }
 
 const (
@@ -53,9 +64,18 @@ const (
 var wwwFS embed.FS
 
 // LoadPluginManifest loads plugin manifest from specified directory
+// or plugin bundle
 func LoadPluginManifest(dir string) (*PluginManifest, error) {
-	fn := filepath.Join(dir, PluginManifestFile)
-	raw, err := os.ReadFile(fn)
+	fsys, err := OpenPluginFS(dir)
+	if err != nil {
+		return nil, err
+	}
+	return LoadPluginManifestFS(fsys)
+}
+
+// LoadPluginManifestFS loads plugin manifest from a file system
+func LoadPluginManifestFS(fsys fs.FS) (*PluginManifest, error) {
+	raw, err := fs.ReadFile(fsys, PluginManifestFile)
 	if err != nil {
 		return nil, err
 	}
@@ -76,9 +96,13 @@ type ServerExt interface {
 }
 
 type plugin struct {
-	name    string
-	dir     string
-	fullDir string
+	spec     string
+	name     string
+	dir      string
+	fullDir  string
+	fsys     fs.FS
+	manifest *PluginManifest
+	err      error
 }
 
 // Server serve static pages and APIs
@@ -93,14 +117,34 @@ type Server struct {
 	WebContentDir string
 	Builtins      []Builtin
 	Title         string
+	Metrics       *Metrics
+	// AdminToken is required by admin requests changing the server,
+	// which are only allowed from loopback if empty
+	AdminToken string
+	// Observers receive messages after they are applied to States
+	Observers []MessageSink
 
-	plugins []*plugin
+	pluginsLock sync.RWMutex
+	plugins     []*plugin
+	pluginSpecs []string
 
 	connsLock sync.RWMutex
-	conns     map[*websocket.Conn]*websocket.Conn
+	conns     map[clientConn]*wsClient
 
 	assetsLock sync.RWMutex
 	assets     map[string]*assetData
+
+	errorsLock sync.RWMutex
+	errors     []MsgError
+
+	typesLock   sync.Mutex
+	warnedTypes map[string]bool
+	// types caches objectTypes until plugins change
+	types    *objectTypes
+	typesGen uint64
+
+	statusLock sync.RWMutex
+	statuses   map[string]Msg
 }
 
 type assetData struct {
@@ -123,8 +167,27 @@ func (l *layeredFs) Open(name string) (http.File, error) {
 	return nil, os.ErrNotExist
 }
 
-// LoadPlugin loads plugin from specified directory
+// LoadPlugin loads plugin from specified directory.
+// The directory is remembered even if loading fails, so ReloadPlugins
+// picks up a plugin manifest created later.
 func (s *Server) LoadPlugin(dir string) error {
+	s.pluginsLock.Lock()
+	found := false
+	for _, spec := range s.pluginSpecs {
+		if spec == dir {
+			found = true
+			break
+		}
+	}
+	if !found {
+		s.pluginSpecs = append(s.pluginSpecs, dir)
+	}
+	s.pluginsLock.Unlock()
+	return s.loadPlugin(dir)
+}
+
+func (s *Server) loadPlugin(spec string) error {
+	dir := spec
 	var name string
 	pos := strings.Index(dir, "=")
 	if pos > 0 {
@@ -135,27 +198,82 @@ func (s *Server) LoadPlugin(dir string) error {
 	if err != nil {
 		return fmt.Errorf("%s: locate error: %v", dir, err)
 	}
-	mf, err := LoadPluginManifest(absDir)
+	fsys, err := OpenPluginFS(absDir)
 	if err != nil {
-		return fmt.Errorf("%s: load error: %v", dir, err)
+		return fmt.Errorf("%s: load error: %w", dir, err)
+	}
+	mf, err := loadValidManifest(fsys)
+	if err != nil {
+		return fmt.Errorf("%s: load error: %w", dir, err)
 	}
 	if name == "" {
 		name = mf.Name
 	}
 	if name == "" {
 		name = filepath.Base(absDir)
+		name = strings.TrimSuffix(name, PluginBundleExt(name))
 	}
 
+	s.pluginsLock.Lock()
+	defer s.pluginsLock.Unlock()
 	for _, p := range s.plugins {
 		if p.name == name {
 			return fmt.Errorf("%s: name '%s' conflict with %s", dir, name, p.dir)
 		}
 	}
 
-	s.plugins = append(s.plugins, &plugin{name: name, dir: dir, fullDir: absDir})
+	s.plugins = append(s.plugins, &plugin{
+		spec:     spec,
+		name:     name,
+		dir:      dir,
+		fullDir:  absDir,
+		fsys:     fsys,
+		manifest: mf,
+	})
+	s.invalidateObjectTypes()
+	return nil
+}
+
+// RemovePlugin unloads a plugin by name
+func (s *Server) RemovePlugin(name string) bool {
+	s.pluginsLock.Lock()
+	defer s.pluginsLock.Unlock()
+	for n, p := range s.plugins {
+		if p.name != name {
+			continue
+		}
+		s.plugins = append(s.plugins[:n], s.plugins[n+1:]...)
+		for i, spec := range s.pluginSpecs {
+			if spec == p.spec {
+				s.pluginSpecs = append(s.pluginSpecs[:i], s.pluginSpecs[i+1:]...)
+				break
+			}
+		}
+		s.invalidateObjectTypes()
+		return true
+	}
+	return false
+}
+
+func (s *Server) findPlugin(name string) *plugin {
+	s.pluginsLock.RLock()
+	defer s.pluginsLock.RUnlock()
+	for _, p := range s.plugins {
+		if p.name == name {
+			return p
+		}
+	}
 	return nil
 }
 
+func (s *Server) loadedPlugins() []*plugin {
+	s.pluginsLock.RLock()
+	plugins := make([]*plugin, len(s.plugins))
+	copy(plugins, s.plugins)
+	s.pluginsLock.RUnlock()
+	return plugins
+}
+
 // Serve runs the server
 func (s *Server) Serve(ext ServerExt) error {
 	h, err := s.Handler(ext)
@@ -178,18 +296,18 @@ func (s *Server) AddBuiltin(builtin Builtin) *Server {
 func (s *Server) Handler(ext ServerExt) (http.Handler, error) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/objects", s.StatesHandler)
+	mux.HandleFunc("/metrics", s.MetricsHandler)
+	mux.HandleFunc(AdminPrefix, s.AdminHandler)
 	mux.Handle("/assets/", http.StripPrefix("/assets", http.HandlerFunc(s.AssetsHandler)))
 	mux.Handle("/ws", websocket.Handler(s.WebSocketHandler))
+	mux.HandleFunc("/events", s.EventsHandler)
+	mux.HandleFunc("/stream", s.StreamHandler)
 	for _, b := range s.Builtins {
 		if b.Handler != nil {
 			prefix := "/" + strings.Trim(b.Path, "/") + "/"
 			mux.Handle(prefix, b.Handler)
 		}
 	}
-	for _, p := range s.plugins {
-		prefix := "/plugins/" + p.name + "/"
-		mux.Handle(prefix, http.StripPrefix(prefix, http.FileServer(http.Dir(p.fullDir))))
-	}
 	lfs := &layeredFs{}
 	if s.LocalWebDir != "" {
 		s.Logger.Infof("Use Local Web Content: %s", s.LocalWebDir)
@@ -206,6 +324,22 @@ func (s *Server) Handler(ext ServerExt) (http.Handler, error) {
 		lfs.Fs = append(lfs.Fs, http.FS(subFS))
 	}
 	fsHandler := http.FileServer(lfs)
+	mux.HandleFunc("/plugins/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/plugins/"), "/", 2)[0]
+		if p := s.findPlugin(name); p != nil {
+			prefix := "/plugins/" + p.name
+			s.pluginsLock.RLock()
+			mf, fsys := p.manifest, p.fsys
+			s.pluginsLock.RUnlock()
+			if mf != nil && !mf.Serves(strings.TrimPrefix(r.URL.Path, prefix)) {
+				http.NotFound(w, r)
+				return
+			}
+			http.StripPrefix(prefix, http.FileServer(http.FS(fsys))).ServeHTTP(w, r)
+		} else {
+			fsHandler.ServeHTTP(w, r)
+		}
+	})
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodGet &&
 			(r.URL.Path == "/" || r.URL.Path == "index.html") {
@@ -265,12 +399,25 @@ func (s *Server) GenerateIndexPage(fs http.FileSystem) (string, error) {
 			ctx.Scripts = append(ctx.Scripts, path.Join(b.Path, fn))
 		}
 	}
-	for _, p := range s.plugins {
-		mf, mfErr := LoadPluginManifest(p.fullDir)
-		if mfErr != nil {
-			s.Logger.Warningf("Load plugin %s (%s) failed: %v", p.name, p.dir, mfErr)
-			continue
+	plugins := s.loadedPlugins()
+	// manifests are cached on plugins, and refreshed by ReloadPlugins,
+	// failures are reported there
+	manifests := make(map[*plugin]*PluginManifest)
+	s.pluginsLock.RLock()
+	for _, p := range plugins {
+		if p.manifest != nil && p.err == nil {
+			manifests[p] = p.manifest
 		}
+	}
+	s.pluginsLock.RUnlock()
+	ordered, errs := resolvePlugins(plugins, manifests)
+	for p, resolveErr := range errs {
+		if manifests[p] != nil {
+			s.Logger.Warningf("Load plugin %s (%s) failed: %v", p.name, p.dir, resolveErr)
+		}
+	}
+	for _, p := range ordered {
+		mf := manifests[p]
 		for _, fn := range mf.Visualizer.Stylesheets {
 			ctx.Stylesheets = append(ctx.Stylesheets, "plugins/"+p.name+"/"+fn)
 		}
@@ -285,89 +432,129 @@ func (s *Server) GenerateIndexPage(fs http.FileSystem) (string, error) {
 
 // WebSocketHandler handles websocket connections
 func (s *Server) WebSocketHandler(ws *websocket.Conn) {
-	s.addConn(ws)
-	defer s.rmConn(ws)
-	dataVals, err := s.DataValues()
-	if err != nil {
+	var remoteAddr string
+	if req := ws.Request(); req != nil {
+		remoteAddr = req.RemoteAddr
+	}
+	client := s.addConn(ws, TransportWebSocket, remoteAddr)
+	defer s.rmConn(client)
+	if err := s.sendSnapshot(client); err != nil {
 		s.Logger.Errorf("States error: %v", err)
 		return
 	}
+
+	decoder := NewMsgDecoder(ws)
+	for {
+		msgs, err := decoder.Decode()
+		if err != nil && err != io.EOF && !client.closed() {
+			s.Logger.Errorf("Read message error: %v", err)
+			s.ReportError("websocket", err)
+		}
+		if err != nil {
+			return
+		}
+		s.recvEvents(msgs)
+	}
+}
+
+// recvEvents forwards events from browsers to the message sink
+func (s *Server) recvEvents(msgs []Msg) {
+	s.metrics().EventsReceived.Add(uint64(len(msgs)))
+	for _, msg := range msgs {
+		s.Logger.Infof("%s: %s", strings.ToUpper(msg.Action()), redactToken(msg).MustEncode())
+	}
+	if s.MsgSink != nil {
+		s.MsgSink.RecvMessages(msgs)
+	}
+}
+
+// redactToken hides the token an event may carry for authorization,
+// like set events to mqhub, before it's logged
+func redactToken(msg Msg) Msg {
+	if _, ok := msg[PropToken]; !ok {
+		return msg
+	}
+	redacted := make(Msg, len(msg))
+	for k, v := range msg {
+		redacted[k] = v
+	}
+	redacted[PropToken] = "REDACTED"
+	return redacted
+}
+
+// sendSnapshot sends current data values, objects and source statuses
+// to a new client
+func (s *Server) sendSnapshot(client *wsClient) error {
+	dataVals, err := s.DataValues()
+	if err != nil {
+		return err
+	}
 	msgs := make([]Msg, 0, len(dataVals))
 	for id, val := range dataVals {
 		msgs = append(msgs, DataValueMsg(id, val))
 	}
-	_, err = ws.Write(MustEncode(msgs))
-	if err != nil {
-		s.Logger.Errorf("Write error: %v", err)
-		return
-	}
+	client.send(MustEncode(msgs), len(msgs))
 	objs, err := s.Objects()
 	if err != nil {
-		s.Logger.Errorf("States error: %v", err)
-		return
+		return err
 	}
 	msgs = make([]Msg, 0, len(objs))
 	for _, obj := range objs {
 		msgs = append(msgs, ObjectMsg(obj))
 	}
-	_, err = ws.Write(MustEncode(msgs))
-	if err != nil {
-		s.Logger.Errorf("Write error: %v", err)
-		return
+	client.send(MustEncode(msgs), len(msgs))
+	s.statusLock.RLock()
+	msgs = make([]Msg, 0, len(s.statuses))
+	for _, status := range s.statuses {
+		msgs = append(msgs, status)
 	}
-
-	decoder := NewMsgDecoder(ws)
-	for {
-		var msgs []Msg
-		msgs, err = decoder.Decode()
-		if err != nil && err != io.EOF {
-			s.Logger.Errorf("Read message error: %v", err)
-		}
-		if err != nil {
-			return
-		}
-		for _, msg := range msgs {
-			s.Logger.Infof("%s: %s", strings.ToUpper(msg.Action()), msg.MustEncode())
-		}
-		// forward to message sink
-		if s.MsgSink != nil {
-			s.MsgSink.RecvMessages(msgs)
-		}
+	s.statusLock.RUnlock()
+	if len(msgs) > 0 {
+		client.send(MustEncode(msgs), len(msgs))
 	}
+	return nil
 }
 
-func (s *Server) addConn(ws *websocket.Conn) {
+func (s *Server) addConn(conn clientConn, transport, remoteAddr string) *wsClient {
+	client := newWsClient(conn, transport, remoteAddr, s.metrics())
 	s.connsLock.Lock()
 	if s.conns == nil {
-		s.conns = make(map[*websocket.Conn]*websocket.Conn)
+		s.conns = make(map[clientConn]*wsClient)
 	}
-	s.conns[ws] = ws
+	s.conns[conn] = client
 	s.connsLock.Unlock()
+	go client.run(s.Logger)
+	return client
 }
 
-func (s *Server) rmConn(ws *websocket.Conn) {
+func (s *Server) rmConn(client *wsClient) {
 	s.connsLock.Lock()
 	if s.conns != nil {
-		if s.conns[ws] == ws {
-			delete(s.conns, ws)
+		if s.conns[client.conn] == client {
+			delete(s.conns, client.conn)
 		}
 	}
 	s.connsLock.Unlock()
-	ws.Close()
+	client.close()
 }
 
-func (s *Server) broadcastMessages(msgs []Msg) {
-	encoded := MustEncode(msgs)
-	var conns []*websocket.Conn
+func (s *Server) clients() []*wsClient {
+	var clients []*wsClient
 	s.connsLock.RLock()
-	if s.conns != nil {
-		for conn := range s.conns {
-			conns = append(conns, conn)
-		}
+	for _, client := range s.conns {
+		clients = append(clients, client)
 	}
 	s.connsLock.RUnlock()
-	for _, conn := range conns {
-		conn.Write(encoded)
+	return clients
+}
+
+func (s *Server) broadcastMessages(msgs []Msg) {
+	encoded := MustEncode(msgs)
+	for _, client := range s.clients() {
+		if !client.send(encoded, len(msgs)) {
+			s.Logger.Warningf("Client %s (%s) dropped: send queue full",
+				client.id, client.remoteAddr)
+		}
 	}
 }
 
@@ -413,10 +600,21 @@ func (s *Server) AssetsHandler(w http.ResponseWriter, r *http.Request) {
 
 // RecvMessages implements MessageSink
 func (s *Server) RecvMessages(msgs []Msg) {
+	start := time.Now()
+	accepted := msgs[:0:0]
 	for _, msg := range msgs {
 		s.HandleMessage(msg)
+		// browsers are only reloaded by the server itself, see NotifyReload
+		if msg.Action() != ActionReload {
+			accepted = append(accepted, msg)
+		}
 	}
+	msgs = accepted
+	s.metrics().RecvDuration.ObserveSince(start)
 	s.broadcastMessages(msgs)
+	for _, o := range s.Observers {
+		o.RecvMessages(msgs)
+	}
 }
 
 // HandleMessage processes one message
@@ -427,6 +625,7 @@ func (s *Server) HandleMessage(a Msg) (err error) {
 		err = s.Reset()
 	case ActionObject:
 		if obj := a.Object(); obj != nil {
+			s.prepareObject(obj)
 			err = s.Update(obj)
 		} else {
 			err = fmt.Errorf("missing property object")
@@ -458,12 +657,46 @@ func (s *Server) HandleMessage(a Msg) (err error) {
 		}
 	case ActionRemove:
 		err = s.Remove(a.ID())
+	case ActionReload:
+		err = fmt.Errorf("reload is only sent by the server")
+	case ActionStatus:
+		s.statusLock.Lock()
+		if s.statuses == nil {
+			s.statuses = make(map[string]Msg)
+		}
+		s.statuses[stringProp(a, PropSource)] = a
+		s.statusLock.Unlock()
+	case ActionError:
+		// the latest error of each source is also sent to new clients
+		source, detail := stringProp(a, PropSource), stringProp(a, PropDetail)
+		s.statusLock.Lock()
+		if s.statuses == nil {
+			s.statuses = make(map[string]Msg)
+		}
+		if detail != "" {
+			s.statuses[ActionError+":"+source] = a
+		} else {
+			delete(s.statuses, ActionError+":"+source)
+		}
+		s.statusLock.Unlock()
+		if detail != "" {
+			s.recordError(MsgError{Time: time.Now(), Source: source, Error: detail})
+		}
 	default:
 		err = fmt.Errorf("unknown action")
 	}
+	s.metrics().Messages.With(action).Inc()
 	if err == nil {
 		s.Logger.Infof("%s: %s", strings.ToUpper(action), a.MustEncode())
 	} else {
+		s.metrics().MessageErrors.With(action).Inc()
+		s.recordError(MsgError{
+			Time:    time.Now(),
+			Source:  "server",
+			Action:  action,
+			Error:   err.Error(),
+			Message: a.MustEncode(),
+		})
 		s.Logger.Errorf("%s: %s: %s", strings.ToUpper(action), err.Error(), a.MustEncode())
 	}
 	return
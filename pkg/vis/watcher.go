@@ -0,0 +1,152 @@
+package vis
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// ReloadDelay is the quiet period after a file change before reloading
+const ReloadDelay = 200 * time.Millisecond
+
+// Properties of reload message
+const (
+	PropScope   = "scope"
+	ScopePage   = "page"
+	ScopeStyles = "styles"
+)
+
+// NotifyReload asks browsers to reload the page, or only the stylesheets
+func (s *Server) NotifyReload(stylesOnly bool) {
+	scope := ScopePage
+	if stylesOnly {
+		scope = ScopeStyles
+	}
+	s.broadcastMessages([]Msg{{PropAction: ActionReload, PropScope: scope}})
+}
+
+// Watcher watches plugin directories and web content for changes,
+// reloads plugins and notifies browsers
+type Watcher struct {
+	Server *Server
+
+	fsw       *fsnotify.Watcher
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Watch starts watching plugin directories and web content
+func (s *Server) Watch() (*Watcher, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{Server: s, fsw: fsw, done: make(chan struct{})}
+	w.addDirs()
+	go w.run()
+	return w, nil
+}
+
+// Close stops watching, it can be called more than once
+func (w *Watcher) Close() (err error) {
+	w.closeOnce.Do(func() {
+		close(w.done)
+		err = w.fsw.Close()
+	})
+	return
+}
+
+func (w *Watcher) addDirs() {
+	s := w.Server
+	watched := make(map[string]bool)
+	for _, p := range s.loadedPlugins() {
+		w.addTree(p.fullDir, watched)
+	}
+	s.pluginsLock.RLock()
+	specs := make([]string, len(s.pluginSpecs))
+	copy(specs, s.pluginSpecs)
+	s.pluginsLock.RUnlock()
+	for _, spec := range specs {
+		// watch only the top directory to detect a new manifest
+		dir := spec
+		if pos := strings.Index(dir, "="); pos > 0 {
+			dir = dir[pos+1:]
+		}
+		if absDir, err := filepath.Abs(dir); err == nil && !watched[absDir] {
+			if w.fsw.Add(absDir) == nil {
+				watched[absDir] = true
+			}
+		}
+	}
+	for _, dir := range []string{s.LocalWebDir, s.WebContentDir} {
+		if dir != "" {
+			if absDir, err := filepath.Abs(dir); err == nil {
+				w.addTree(absDir, watched)
+			}
+		}
+	}
+}
+
+func (w *Watcher) addTree(root string, watched map[string]bool) {
+	if PluginBundleExt(root) != "" {
+		if !watched[root] && w.fsw.Add(root) == nil {
+			watched[root] = true
+		}
+		return
+	}
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if path != root && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !watched[path] && w.fsw.Add(path) == nil {
+			watched[path] = true
+		}
+		return nil
+	})
+}
+
+func (w *Watcher) run() {
+	var timer <-chan time.Time
+	stylesOnly := true
+	for {
+		select {
+		case <-w.done:
+			return
+		case event, ok := <-w.fsw.Events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Chmod) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					w.addTree(event.Name, make(map[string]bool))
+				}
+			}
+			if filepath.Ext(event.Name) != ".css" {
+				stylesOnly = false
+			}
+			timer = time.After(ReloadDelay)
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+			w.Server.Logger.Warningf("Watch error: %v", err)
+		case <-timer:
+			timer = nil
+			w.Server.ReloadPlugins()
+			w.addDirs()
+			w.Server.Logger.Infof("Content changed, reload browsers")
+			w.Server.NotifyReload(stylesOnly)
+			stylesOnly = true
+		}
+	}
+}
@@ -201,6 +201,7 @@
             this._factories = {};
             this._objects = {};
             this._data = {};
+            this._errors = {};
         },
 
         start: function (elem) {
@@ -432,6 +433,38 @@
             this._data[cmd.id] = cmd.value;
         },
 
+        _update_reload: function (cmd) {
+            if (cmd.scope != 'styles') {
+                location.reload();
+                return;
+            }
+            var ts = Date.now();
+            $('link[rel="stylesheet"]').each(function () {
+                var href = this.getAttribute('href').replace(/[?&]reload=\d+$/, '');
+                this.setAttribute('href', href + (href.indexOf('?') < 0 ? '?' : '&') + 'reload=' + ts);
+            });
+        },
+
+        _update_error: function (cmd) {
+            var source = cmd.source || 'source';
+            if (cmd.detail) {
+                this._errors[source] = cmd.detail;
+            } else {
+                delete this._errors[source];
+            }
+            var errors = [];
+            for (var name in this._errors) {
+                errors.push(name + ': ' + this._errors[name]);
+            }
+            $('#source-error').text(errors.join('; '));
+        },
+
+        _update_status: function (cmd) {
+            var elem = $('#source-status');
+            elem.text(cmd.connected ? '' : (cmd.source || 'source') + ': ' + (cmd.detail || 'disconnected'));
+            elem.toggleClass('disconnected', !cmd.connected);
+        },
+
         _update_remove: function (cmd) {
             if (typeof(cmd.id) == 'string') {
                 var obj = this._objects[cmd.id];
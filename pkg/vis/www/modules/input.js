@@ -0,0 +1,102 @@
+(function(exports) {
+    'use strict';
+
+    // token for writing endpoints, asked on the first write and kept for
+    // the session, not in the URL which ends up in logs and history
+    var TOKEN_KEY = 'see.mqhub.token';
+
+    function writeToken() {
+        var token = window.sessionStorage.getItem(TOKEN_KEY);
+        if (!token) {
+            token = window.prompt('Token for writing endpoints');
+            if (token) {
+                window.sessionStorage.setItem(TOKEN_KEY, token);
+            }
+        }
+        return token;
+    }
+
+    var InputObject = {
+        update: function (props) {
+            this.properties = props;
+            if (this._input) {
+                this._setValue(props.value);
+                return true;
+            }
+            return false;
+        },
+
+        // _set writes the endpoint with PUT, the token goes in the header
+        // rather than the events which are logged by the server
+        _set: function (value) {
+            var token = writeToken();
+            if (!token) {
+                this._setValue(this.properties.value);
+                return;
+            }
+            var props = this.properties;
+            var path = encodeURIComponent(props.component) + '/' + encodeURIComponent(props.endpoint);
+            var source = 'set ' + props.component + '/' + props.endpoint;
+            $.ajax({
+                url: 'mqhub/states/' + path,
+                method: 'PUT',
+                contentType: 'application/json',
+                data: JSON.stringify(value),
+                headers: { Authorization: 'Bearer ' + token }
+            }).done(function () {
+                this.world.update([{ action: 'error', source: source }]);
+            }.bind(this)).fail(function (xhr) {
+                if (xhr.status == 401 || xhr.status == 403) {
+                    // ask again on the next write
+                    window.sessionStorage.removeItem(TOKEN_KEY);
+                }
+                this._setValue(this.properties.value);
+                this.world.update([{
+                    action: 'error',
+                    source: source,
+                    detail: $.trim(xhr.responseText) || xhr.statusText || 'failed'
+                }]);
+            }.bind(this));
+        }
+    };
+
+    vis.defineObject('slider', $.extend({
+        createContent: function () {
+            var input = document.createElement('input');
+            input.type = 'range';
+            this._input = input;
+            this._setValue(this.properties.value);
+            input.addEventListener('change', function () {
+                this._set(parseFloat(input.value));
+            }.bind(this));
+            return input;
+        },
+
+        _setValue: function (value) {
+            var props = this.properties;
+            this._input.min = props.min != null ? props.min : 0;
+            this._input.max = props.max != null ? props.max : 100;
+            this._input.step = props.step != null ? props.step : 1;
+            if (typeof(value) == 'number') {
+                this._input.value = value;
+            }
+        }
+    }, InputObject));
+
+    vis.defineObject('toggle', $.extend({
+        createContent: function () {
+            var input = document.createElement('input');
+            input.type = 'checkbox';
+            this._input = input;
+            this._setValue(this.properties.value);
+            input.addEventListener('change', function () {
+                this._set(input.checked);
+            }.bind(this));
+            return input;
+        },
+
+        _setValue: function (value) {
+            this._input.checked = !!value;
+        }
+    }, InputObject));
+})(window);